@@ -0,0 +1,92 @@
+package echoprometheus
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultBuckets are the duration buckets used when Buckets is empty, from 0.5ms to 30s
+var defaultBuckets = []float64{
+	0.0005,
+	0.001, // 1ms
+	0.002,
+	0.005,
+	0.01, // 10ms
+	0.02,
+	0.05,
+	0.1, // 100 ms
+	0.2,
+	0.5,
+	1.0, // 1s
+	2.0,
+	5.0,
+	10.0, // 10s
+	15.0,
+	20.0,
+	30.0,
+}
+
+// DefaultBuckets returns a copy of the default duration buckets, safe to modify
+func DefaultBuckets() []float64 {
+	return slices.Clone(defaultBuckets)
+}
+
+// defaultSizeBuckets returns the default size buckets, from 64B to 16MB
+func defaultSizeBuckets() []float64 {
+	return prometheus.ExponentialBuckets(64, 2, 19)
+}
+
+// FastAPIBuckets are duration buckets for APIs answering under 50ms
+var FastAPIBuckets = []float64{
+	0.0001, // 0.1ms
+	0.00025,
+	0.0005,
+	0.001, // 1ms
+	0.0025,
+	0.005,
+	0.01, // 10ms
+	0.025,
+	0.05, // 50ms
+	0.1,
+	0.25,
+}
+
+// SlowAPIBuckets are duration buckets for APIs taking up to minutes
+var SlowAPIBuckets = []float64{
+	0.05, // 50ms
+	0.1,
+	0.25,
+	0.5,
+	1.0, // 1s
+	2.5,
+	5.0,
+	10.0, // 10s
+	30.0,
+	60.0, // 1m
+	120.0,
+	300.0, // 5m
+	600.0,
+}
+
+// LinearDurationBuckets returns count duration buckets, in seconds, starting at start and spaced by width
+func LinearDurationBuckets(start, width float64, count int) []float64 {
+	return prometheus.LinearBuckets(start, width, count)
+}
+
+// ExponentialDurationBuckets returns count duration buckets, in seconds, starting at start and multiplied by factor
+func ExponentialDurationBuckets(start, factor float64, count int) []float64 {
+	return prometheus.ExponentialBuckets(start, factor, count)
+}
+
+// scaleBuckets returns a copy of buckets multiplied by factor
+func scaleBuckets(buckets []float64, factor float64) []float64 {
+	scaled := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		scaled[i] = bucket * factor
+	}
+	return scaled
+}
+
+// websocketBuckets cover websocket connection lifetimes, from 1s to about 4.5h
+var websocketBuckets = prometheus.ExponentialBuckets(1, 4, 8)
@@ -0,0 +1,48 @@
+package echoprometheus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBucketPresetsValid(t *testing.T) {
+	for name, buckets := range map[string][]float64{
+		"FastAPIBuckets": FastAPIBuckets,
+		"SlowAPIBuckets": SlowAPIBuckets,
+	} {
+		config := NewConfig()
+		config.Buckets = buckets
+		if err := config.Validate(); err != nil {
+			t.Errorf("expected %s to be valid, got %v", name, err)
+		}
+	}
+}
+
+func TestDurationBucketHelpers(t *testing.T) {
+	if buckets := LinearDurationBuckets(1, 0.5, 3); !reflect.DeepEqual(buckets, []float64{1, 1.5, 2}) {
+		t.Errorf("unexpected linear buckets %v", buckets)
+	}
+	if buckets := ExponentialDurationBuckets(0.01, 10, 4); !reflect.DeepEqual(buckets, []float64{0.01, 0.1, 1, 10}) {
+		t.Errorf("unexpected exponential buckets %v", buckets)
+	}
+}
+
+func TestDefaultBucketsCopies(t *testing.T) {
+	original := DefaultBuckets()
+	originalSizes := append([]float64(nil), DefaultConfig.SizeBuckets...)
+
+	buckets := DefaultBuckets()
+	buckets[0] = 42
+	config := NewConfig()
+	config.SizeBuckets[0] = 42
+
+	if DefaultConfig.Buckets != nil {
+		t.Errorf("expected DefaultConfig.Buckets to stay empty, got %v", DefaultConfig.Buckets)
+	}
+	if !reflect.DeepEqual(DefaultConfig.SizeBuckets, originalSizes) {
+		t.Errorf("expected DefaultConfig.SizeBuckets to be unchanged, got %v", DefaultConfig.SizeBuckets)
+	}
+	if !reflect.DeepEqual(DefaultBuckets(), original) {
+		t.Errorf("expected DefaultBuckets to return the defaults, got %v", DefaultBuckets())
+	}
+}
@@ -0,0 +1,207 @@
+package echoprometheus
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// seriesKey identifies a series of the requests counter or the duration metric
+type seriesKey struct {
+	status, code, method, handler, extra string
+}
+
+func newSeriesKey(status []string, method, handler string, extra []string) seriesKey {
+	key := seriesKey{method: method, handler: handler}
+	if len(status) > 0 {
+		key.status = status[0]
+	}
+	if len(status) > 1 {
+		key.code = status[1]
+	}
+	if len(extra) > 0 {
+		key.extra = strings.Join(extra, "\xff")
+	}
+	return key
+}
+
+// seriesCache keeps the children of a vector by label values, so repeated requests
+// skip building the label values slice and the vector lookup.
+// A nil cache always looks up the vector.
+type seriesCache struct {
+	children sync.Map
+}
+
+func (s *seriesCache) observer(vec prometheus.ObserverVec, method, handler string, extra []string) prometheus.Observer {
+	if s == nil {
+		return vec.WithLabelValues(append([]string{method, handler}, extra...)...)
+	}
+
+	key := newSeriesKey(nil, method, handler, extra)
+	if o, ok := s.children.Load(key); ok {
+		return o.(prometheus.Observer)
+	}
+	o, _ := s.children.LoadOrStore(key, vec.WithLabelValues(append([]string{method, handler}, extra...)...))
+	return o.(prometheus.Observer)
+}
+
+func (s *seriesCache) counter(vec *prometheus.CounterVec, status []string, method, handler string, extra []string) prometheus.Counter {
+	if s == nil {
+		return vec.WithLabelValues(append(append(status, method, handler), extra...)...)
+	}
+
+	key := newSeriesKey(status, method, handler, extra)
+	if c, ok := s.children.Load(key); ok {
+		return c.(prometheus.Counter)
+	}
+	c, _ := s.children.LoadOrStore(key, vec.WithLabelValues(append(append(status, method, handler), extra...)...))
+	return c.(prometheus.Counter)
+}
+
+// reset forgets the cached children, it must be called when the vector is reset
+func (s *seriesCache) reset() {
+	if s == nil {
+		return
+	}
+	s.children.Range(func(key, _ interface{}) bool {
+		s.children.Delete(key)
+		return true
+	})
+}
+
+// labelLimiter caps the number of distinct values of a label.
+// A nil limiter allows every value.
+type labelLimiter struct {
+	max  int
+	mu   sync.RWMutex
+	seen map[string]struct{}
+}
+
+func newLabelLimiter(max int) *labelLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &labelLimiter{max: max, seen: make(map[string]struct{}, max)}
+}
+
+// allow reports whether value is already known or fits under the limit
+func (l *labelLimiter) allow(value string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.RLock()
+	_, ok := l.seen[value]
+	l.mu.RUnlock()
+	if ok {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[value]; ok {
+		return true
+	}
+	if len(l.seen) >= l.max {
+		return false
+	}
+	l.seen[value] = struct{}{}
+	return true
+}
+
+// labelLRU keeps the most recently seen values of a label. A value is only kept the second time
+// it is seen, the values seen once are remembered in a second list of the same size.
+type labelLRU struct {
+	max       int
+	mu        sync.Mutex
+	order     *list.List
+	items     map[string]*list.Element
+	seenOrder *list.List
+	seenItems map[string]*list.Element
+}
+
+func newLabelLRU(max int) *labelLRU {
+	return &labelLRU{
+		max:       max,
+		order:     list.New(),
+		items:     make(map[string]*list.Element, max),
+		seenOrder: list.New(),
+		seenItems: make(map[string]*list.Element, max),
+	}
+}
+
+// get returns value when it is kept, and the value it evicted if any. A value seen for the first time
+// is collapsed to other without evicting anything, so a scan of unique paths cannot push out the values
+// in use. Seen again, it is kept, evicting the least recently seen value when the LRU is full.
+func (l *labelLRU) get(value string) (label, evicted string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.items[value]; ok {
+		l.order.MoveToFront(e)
+		return value, ""
+	}
+
+	if l.order.Len() < l.max {
+		l.items[value] = l.order.PushFront(value)
+		return value, ""
+	}
+
+	e, ok := l.seenItems[value]
+	if !ok {
+		if l.seenOrder.Len() >= l.max {
+			delete(l.seenItems, l.seenOrder.Remove(l.seenOrder.Back()).(string))
+		}
+		l.seenItems[value] = l.seenOrder.PushFront(value)
+		return otherLabel, ""
+	}
+	l.seenOrder.Remove(e)
+	delete(l.seenItems, value)
+
+	evicted = l.order.Remove(l.order.Back()).(string)
+	delete(l.items, evicted)
+	l.items[value] = l.order.PushFront(value)
+	return value, evicted
+}
+
+// handlerEvictions deletes the series of the handler labels evicted by LimitedLabels in the background,
+// so requests do not wait for every vector to be scanned
+type handlerEvictions struct {
+	mu            sync.Mutex
+	pending       map[string]struct{}
+	wake          chan struct{}
+	start         sync.Once
+	deleteHandler func(handler string)
+}
+
+func newHandlerEvictions(deleteHandler func(handler string)) *handlerEvictions {
+	return &handlerEvictions{pending: make(map[string]struct{}), wake: make(chan struct{}, 1), deleteHandler: deleteHandler}
+}
+
+// add schedules the deletion of the handler series, starting the deleting goroutine on the first eviction
+func (e *handlerEvictions) add(handler string) {
+	e.start.Do(func() {
+		go e.run()
+	})
+	e.mu.Lock()
+	e.pending[handler] = struct{}{}
+	e.mu.Unlock()
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *handlerEvictions) run() {
+	for range e.wake {
+		e.mu.Lock()
+		pending := e.pending
+		e.pending = make(map[string]struct{})
+		e.mu.Unlock()
+		for handler := range pending {
+			e.deleteHandler(handler)
+		}
+	}
+}
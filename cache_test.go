@@ -0,0 +1,184 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// discardWriter is a response writer dropping everything, so benchmarks only measure the middleware
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// benchmarkServe serves GET target with e b.N times
+func benchmarkServe(b *testing.B, e *echo.Echo, target string) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.ServeHTTP(w, req)
+	}
+}
+
+func BenchmarkMiddlewareSeries(b *testing.B) {
+	for _, cache := range []bool{false, true} {
+		b.Run("CacheSeries="+strconv.FormatBool(cache), func(b *testing.B) {
+			config, _ := newTestConfig()
+			config.CacheSeries = cache
+			e, _ := newTestServer(config)
+			benchmarkServe(b, e, "/foo")
+		})
+	}
+}
+
+func TestCacheSeriesRecordsLikeUncached(t *testing.T) {
+	for _, cache := range []bool{false, true} {
+		config, registry := newTestConfig()
+		config.CacheSeries = cache
+		e, collectors := newTestServer(config)
+		for i := 0; i < 3; i++ {
+			serve(e, http.MethodGet, "/foo")
+		}
+
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo")); count != 3 {
+			t.Errorf("CacheSeries=%v: expected 3 requests, got %v", cache, count)
+		}
+		if count := sampleCount(t, registry, "echo_http_request_duration_seconds"); count != 3 {
+			t.Errorf("CacheSeries=%v: expected 3 observations, got %d", cache, count)
+		}
+
+		// reset series are not kept in the cache
+		collectors.Reset()
+		serve(e, http.MethodGet, "/foo")
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo")); count != 1 {
+			t.Errorf("CacheSeries=%v: expected 1 request after Reset, got %v", cache, count)
+		}
+	}
+}
+
+func TestLabelLimiterConcurrent(t *testing.T) {
+	const max = 10
+	limiter := newLabelLimiter(max)
+	var allowed sync.Map
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(value string) {
+			defer wg.Done()
+			if limiter.allow(value) {
+				allowed.Store(value, true)
+			}
+		}(strconv.Itoa(i % 50))
+	}
+	wg.Wait()
+
+	count := 0
+	allowed.Range(func(key, _ interface{}) bool {
+		count++
+		if !limiter.allow(key.(string)) {
+			t.Errorf("expected the allowed value %s to stay allowed", key)
+		}
+		return true
+	})
+	if count != max {
+		t.Errorf("expected %d allowed values, got %d", max, count)
+	}
+	if !newLabelLimiter(0).allow("any") {
+		t.Error("expected no limit with a zero max")
+	}
+}
+
+func TestLabelLRUStaysBounded(t *testing.T) {
+	lru := newLabelLRU(3)
+	for i := 0; i < 100; i++ {
+		// each value is seen twice, so it is kept the second time
+		lru.get("/path/" + strconv.Itoa(i))
+		lru.get("/path/" + strconv.Itoa(i))
+	}
+	if n := lru.order.Len(); n != 3 {
+		t.Fatalf("expected 3 kept values, got %d", n)
+	}
+
+	for _, value := range []string{"/path/97", "/path/98", "/path/99"} {
+		if label, evicted := lru.get(value); label != value || evicted != "" {
+			t.Errorf("expected the recent %s to be kept, got %q evicting %q", value, label, evicted)
+		}
+	}
+	if label, evicted := lru.get("/path/0"); label != otherLabel || evicted != "" {
+		t.Errorf("expected a new value to be collapsed without evicting, got %q evicting %q", label, evicted)
+	}
+	if label, evicted := lru.get("/path/0"); label != "/path/0" || evicted != "/path/97" {
+		t.Errorf("expected a value seen again to be kept evicting the oldest, got %q evicting %q", label, evicted)
+	}
+}
+
+func TestLabelLRUScanKeepsValues(t *testing.T) {
+	lru := newLabelLRU(3)
+	for _, value := range []string{"/a", "/b", "/c"} {
+		lru.get(value)
+	}
+	for i := 0; i < 100; i++ {
+		if label, evicted := lru.get("/scan/" + strconv.Itoa(i)); label != otherLabel || evicted != "" {
+			t.Fatalf("expected a value seen once to be collapsed without evicting, got %q evicting %q", label, evicted)
+		}
+	}
+	for _, value := range []string{"/a", "/b", "/c"} {
+		if label, _ := lru.get(value); label != value {
+			t.Errorf("expected %s to be kept after the scan, got %q", value, label)
+		}
+	}
+	if n := lru.seenOrder.Len(); n != 3 || len(lru.seenItems) != 3 {
+		t.Errorf("expected 3 values seen once to be remembered, got %d", n)
+	}
+}
+
+func TestLabelLRUConcurrent(t *testing.T) {
+	lru := newLabelLRU(10)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				lru.get(strconv.Itoa(g*1000 + i%50))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n, items := lru.order.Len(), len(lru.items); n != 10 || items != 10 {
+		t.Errorf("expected 10 kept values, got %d in the list and %d in the map", n, items)
+	}
+	if n, items := lru.seenOrder.Len(), len(lru.seenItems); n != items || n > 10 {
+		t.Errorf("expected at most 10 values seen once, got %d in the list and %d in the map", n, items)
+	}
+}
+
+func TestHandlerEvictions(t *testing.T) {
+	deleted := make(chan string, 1)
+	evictions := newHandlerEvictions(func(handler string) {
+		deleted <- handler
+	})
+	evictions.add("/old")
+
+	select {
+	case handler := <-deleted:
+		if handler != "/old" {
+			t.Errorf("expected /old to be deleted, got %s", handler)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the evicted handler to be deleted in the background")
+	}
+}
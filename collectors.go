@@ -0,0 +1,693 @@
+package echoprometheus
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Collectors holds the collectors created by the middleware, disabled ones are nil.
+// They can be read directly in tests, for instance with testutil.ToFloat64.
+type Collectors struct {
+	RequestsTotal        *prometheus.CounterVec
+	RequestDuration      prometheus.ObserverVec
+	RequestsInFlight     *prometheus.GaugeVec
+	RequestSize          *prometheus.HistogramVec
+	ResponseSize         *prometheus.HistogramVec
+	TimeToFirstByte      *prometheus.HistogramVec
+	Errors               *prometheus.CounterVec
+	Panics               *prometheus.CounterVec
+	RequestsStarted      *prometheus.CounterVec
+	LastRequestTimestamp *prometheus.GaugeVec
+	QueueTime            *prometheus.HistogramVec
+	BuildInfo            prometheus.Gauge
+	CardinalityLimitHits prometheus.Counter
+	RequestsByClass      *prometheus.CounterVec
+	RequestsInFlightMax  prometheus.GaugeFunc
+	WebsocketDuration    *prometheus.HistogramVec
+	PhaseDuration        *prometheus.HistogramVec
+	SLOViolations        *prometheus.CounterVec
+	LastRequestDuration  *prometheus.GaugeVec
+	RequestBytes         *prometheus.CounterVec
+	ResponseBytes        *prometheus.CounterVec
+	DeadlineExceeded     *prometheus.CounterVec
+	Up                   prometheus.Gauge
+
+	requestsCache, durationCache *seriesCache
+	inFlight                     *inFlightTracker
+	evictions                    *handlerEvictions
+
+	gatherer         prometheus.Gatherer
+	requestsName     string
+	durationName     string
+	statusLabelNames []string
+	methodLabelName  string
+	handlerLabelName string
+}
+
+// newCollectors creates the collectors enabled by config, without registering them
+func newCollectors(config Config, statusLabelNames, extraLabelNames []string) *Collectors {
+	c := &Collectors{
+		gatherer:         gathererFor(config),
+		requestsName:     prometheus.BuildFQName(config.Namespace, config.Subsystem, config.RequestsCounterName),
+		durationName:     prometheus.BuildFQName(config.Namespace, config.Subsystem, config.DurationHistogramName),
+		statusLabelNames: statusLabelNames,
+		methodLabelName:  config.MethodLabelName,
+		handlerLabelName: config.HandlerLabelName,
+	}
+
+	labels := func(names ...string) []string {
+		return append([]string{config.MethodLabelName, config.HandlerLabelName}, names...)
+	}
+
+	// the duration histograms other than the request duration are always in seconds
+	secondsBuckets := config.DurationUnit.seconds(config.Buckets)
+
+	if !config.DisableRequestCounter {
+		labelNames := append(statusLabelNames, labels(extraLabelNames...)...)
+		if config.OutcomeFunc != nil {
+			labelNames = append(labelNames, "outcome")
+		}
+		c.RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        config.RequestsCounterName,
+			Help:        config.RequestsCounterHelp,
+		}, labelNames)
+	}
+
+	if !config.DisableDurationHistogram {
+		c.RequestDuration = newDurationCollector(config, labels(extraLabelNames...))
+	}
+
+	if !config.DisableInFlightGauge {
+		c.RequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpRequestsInFlight,
+			Help:        "Number of HTTP requests being processed",
+		}, labels())
+	}
+
+	if config.EnableSizeMetrics {
+		c.RequestSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpRequestSize,
+			Help:        "Size of HTTP request bodies",
+			Buckets:     config.SizeBuckets,
+		}, labels())
+
+		responseSizeLabels := labels()
+		if config.EnableCompressedLabel {
+			responseSizeLabels = labels("compressed")
+		}
+		c.ResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpResponseSize,
+			Help:        "Size of HTTP response bodies",
+			Buckets:     config.SizeBuckets,
+		}, responseSizeLabels)
+	}
+
+	if config.EnableTTFB {
+		c.TimeToFirstByte = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpTimeToFirstByte,
+			Help:        "Time until the first byte of the response is written",
+			Buckets:     secondsBuckets,
+		}, labels())
+	}
+
+	if config.EnableErrorMetric {
+		c.Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpErrorsCount,
+			Help:        "Number of HTTP requests by type of error returned by the handler",
+		}, labels("type"))
+	}
+
+	if config.RecoverPanics || config.InstrumentPanics {
+		c.Panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpPanicsCount,
+			Help:        "Number of HTTP handlers panics",
+		}, labels())
+	}
+
+	if config.EnableStartedCounter {
+		c.RequestsStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpRequestsStarted,
+			Help:        "Number of HTTP requests started",
+		}, labels())
+	}
+
+	if config.EnableLastRequestGauge {
+		c.LastRequestTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpLastRequestTimestamp,
+			Help:        "Unix time of the last HTTP request",
+		}, labels())
+	}
+
+	if config.QueueTimeHeader != "" {
+		c.QueueTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpQueueTime,
+			Help:        "Time spent by HTTP requests between the edge proxy and the handler",
+			Buckets:     secondsBuckets,
+		}, labels())
+	}
+
+	if config.BuildInfo != nil {
+		c.BuildInfo = newBuildInfoGauge(config)
+	}
+
+	if config.MaxHandlerCardinality > 0 {
+		c.CardinalityLimitHits = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        cardinalityLimitHits,
+			Help:        "Number of HTTP requests whose handler label was collapsed by MaxHandlerCardinality",
+		})
+	}
+
+	if config.EnableClassOnlyCounter {
+		c.RequestsByClass = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpRequestsByClass,
+			Help:        "Number of HTTP requests processed by status class",
+		}, []string{"class"})
+	}
+
+	if config.EnableInFlightMax {
+		c.RequestsInFlightMax = newInFlightTracker(config)
+	}
+
+	if config.SeparateWebsocketMetrics {
+		c.WebsocketDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        websocketConnectionDuration,
+			Help:        "Lifetime of websocket connections",
+			Buckets:     websocketBuckets,
+		}, labels())
+	}
+
+	if config.EnablePhaseMetrics {
+		c.PhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpPhaseDuration,
+			Help:        "Time spent in the phases of HTTP requests",
+			Buckets:     secondsBuckets,
+		}, labels("phase"))
+	}
+
+	if config.SLOThreshold > 0 {
+		c.SLOViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpSLOViolations,
+			Help:        "Number of HTTP requests slower than the latency SLO",
+		}, labels())
+	}
+
+	if config.EnableLastDurationGauge {
+		c.LastRequestDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpLastRequestDuration,
+			Help:        "Duration of the last HTTP request",
+		}, labels())
+	}
+
+	if config.EnableByteCounters {
+		c.RequestBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpRequestBytes,
+			Help:        "Total size of the HTTP requests bodies",
+		}, labels())
+
+		c.ResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpResponseBytes,
+			Help:        "Total size of the HTTP responses bodies",
+		}, labels())
+	}
+
+	if config.EnableDeadlineMetric {
+		c.DeadlineExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        httpDeadlineExceeded,
+			Help:        "Number of HTTP requests whose context deadline was exceeded when the handler returned",
+		}, labels())
+	}
+
+	if config.EnableUpGauge {
+		c.Up = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   config.Namespace,
+			ConstLabels: config.ConstLabels,
+			Name:        appUp,
+			Help:        "Whether the service is ready, as set by the application",
+		})
+	}
+
+	if config.CacheSeries {
+		c.requestsCache, c.durationCache = &seriesCache{}, &seriesCache{}
+	}
+	c.evictions = newHandlerEvictions(c.deleteHandler)
+
+	return c
+}
+
+// register registers the collectors, replacing each one by the already registered collector when it exists.
+// It stops at the first registration error, unregistering the collectors it registered, reused ones are kept.
+func (c *Collectors) register(registerer prometheus.Registerer) error {
+	var err error
+	var registered []prometheus.Collector
+	reg := func(collector prometheus.Collector) prometheus.Collector {
+		if err != nil {
+			return collector
+		}
+		var existing prometheus.Collector
+		if existing, err = registerCollector(registerer, collector); err == nil && existing == collector {
+			registered = append(registered, collector)
+		}
+		return existing
+	}
+
+	if c.RequestsTotal != nil {
+		c.RequestsTotal = reg(c.RequestsTotal).(*prometheus.CounterVec)
+	}
+	if c.RequestDuration != nil {
+		c.RequestDuration = reg(c.RequestDuration).(prometheus.ObserverVec)
+	}
+	if c.RequestsInFlight != nil {
+		c.RequestsInFlight = reg(c.RequestsInFlight).(*prometheus.GaugeVec)
+	}
+	if c.RequestSize != nil {
+		c.RequestSize = reg(c.RequestSize).(*prometheus.HistogramVec)
+	}
+	if c.ResponseSize != nil {
+		c.ResponseSize = reg(c.ResponseSize).(*prometheus.HistogramVec)
+	}
+	if c.TimeToFirstByte != nil {
+		c.TimeToFirstByte = reg(c.TimeToFirstByte).(*prometheus.HistogramVec)
+	}
+	if c.Errors != nil {
+		c.Errors = reg(c.Errors).(*prometheus.CounterVec)
+	}
+	if c.Panics != nil {
+		c.Panics = reg(c.Panics).(*prometheus.CounterVec)
+	}
+	if c.RequestsStarted != nil {
+		c.RequestsStarted = reg(c.RequestsStarted).(*prometheus.CounterVec)
+	}
+	if c.LastRequestTimestamp != nil {
+		c.LastRequestTimestamp = reg(c.LastRequestTimestamp).(*prometheus.GaugeVec)
+	}
+	if c.QueueTime != nil {
+		c.QueueTime = reg(c.QueueTime).(*prometheus.HistogramVec)
+	}
+	if c.BuildInfo != nil {
+		c.BuildInfo = reg(c.BuildInfo).(prometheus.Gauge)
+	}
+	if c.CardinalityLimitHits != nil {
+		c.CardinalityLimitHits = reg(c.CardinalityLimitHits).(prometheus.Counter)
+	}
+	if c.RequestsByClass != nil {
+		c.RequestsByClass = reg(c.RequestsByClass).(*prometheus.CounterVec)
+	}
+	if c.RequestsInFlightMax != nil {
+		c.RequestsInFlightMax = reg(c.RequestsInFlightMax).(prometheus.GaugeFunc)
+		// the registered tracker is shared with the middlewares reusing it
+		c.inFlight, _ = c.RequestsInFlightMax.(*inFlightTracker)
+	}
+	if c.WebsocketDuration != nil {
+		c.WebsocketDuration = reg(c.WebsocketDuration).(*prometheus.HistogramVec)
+	}
+	if c.PhaseDuration != nil {
+		c.PhaseDuration = reg(c.PhaseDuration).(*prometheus.HistogramVec)
+	}
+	if c.SLOViolations != nil {
+		c.SLOViolations = reg(c.SLOViolations).(*prometheus.CounterVec)
+	}
+	if c.LastRequestDuration != nil {
+		c.LastRequestDuration = reg(c.LastRequestDuration).(*prometheus.GaugeVec)
+	}
+	if c.RequestBytes != nil {
+		c.RequestBytes = reg(c.RequestBytes).(*prometheus.CounterVec)
+	}
+	if c.ResponseBytes != nil {
+		c.ResponseBytes = reg(c.ResponseBytes).(*prometheus.CounterVec)
+	}
+	if c.DeadlineExceeded != nil {
+		c.DeadlineExceeded = reg(c.DeadlineExceeded).(*prometheus.CounterVec)
+	}
+	if c.Up != nil {
+		c.Up = reg(c.Up).(prometheus.Gauge)
+	}
+
+	if err != nil {
+		// the middleware is not returned, its collectors must not be exposed
+		for _, collector := range registered {
+			registerer.Unregister(collector)
+		}
+	}
+	return err
+}
+
+// all returns the collectors that are not disabled
+func (c *Collectors) all() []prometheus.Collector {
+	var collectors []prometheus.Collector
+	if c.RequestsTotal != nil {
+		collectors = append(collectors, c.RequestsTotal)
+	}
+	if c.RequestDuration != nil {
+		collectors = append(collectors, c.RequestDuration)
+	}
+	if c.RequestsInFlight != nil {
+		collectors = append(collectors, c.RequestsInFlight)
+	}
+	if c.RequestSize != nil {
+		collectors = append(collectors, c.RequestSize)
+	}
+	if c.ResponseSize != nil {
+		collectors = append(collectors, c.ResponseSize)
+	}
+	if c.TimeToFirstByte != nil {
+		collectors = append(collectors, c.TimeToFirstByte)
+	}
+	if c.Errors != nil {
+		collectors = append(collectors, c.Errors)
+	}
+	if c.Panics != nil {
+		collectors = append(collectors, c.Panics)
+	}
+	if c.RequestsStarted != nil {
+		collectors = append(collectors, c.RequestsStarted)
+	}
+	if c.LastRequestTimestamp != nil {
+		collectors = append(collectors, c.LastRequestTimestamp)
+	}
+	if c.QueueTime != nil {
+		collectors = append(collectors, c.QueueTime)
+	}
+	if c.BuildInfo != nil {
+		collectors = append(collectors, c.BuildInfo)
+	}
+	if c.CardinalityLimitHits != nil {
+		collectors = append(collectors, c.CardinalityLimitHits)
+	}
+	if c.RequestsByClass != nil {
+		collectors = append(collectors, c.RequestsByClass)
+	}
+	if c.RequestsInFlightMax != nil {
+		collectors = append(collectors, c.RequestsInFlightMax)
+	}
+	if c.WebsocketDuration != nil {
+		collectors = append(collectors, c.WebsocketDuration)
+	}
+	if c.PhaseDuration != nil {
+		collectors = append(collectors, c.PhaseDuration)
+	}
+	if c.SLOViolations != nil {
+		collectors = append(collectors, c.SLOViolations)
+	}
+	if c.LastRequestDuration != nil {
+		collectors = append(collectors, c.LastRequestDuration)
+	}
+	if c.RequestBytes != nil {
+		collectors = append(collectors, c.RequestBytes)
+	}
+	if c.ResponseBytes != nil {
+		collectors = append(collectors, c.ResponseBytes)
+	}
+	if c.DeadlineExceeded != nil {
+		collectors = append(collectors, c.DeadlineExceeded)
+	}
+	if c.Up != nil {
+		collectors = append(collectors, c.Up)
+	}
+	return collectors
+}
+
+// deleteHandler deletes the series of every collector with the handler label value, so the next request
+// with it starts new series, see LimitedLabels
+func (c *Collectors) deleteHandler(handler string) {
+	labels := prometheus.Labels{c.handlerLabelName: handler}
+	for _, collector := range c.all() {
+		if vec, ok := collector.(interface{ DeletePartialMatch(prometheus.Labels) int }); ok {
+			vec.DeletePartialMatch(labels)
+		}
+	}
+	// cached series would keep recording into the deleted ones
+	c.requestsCache.reset()
+	c.durationCache.reset()
+}
+
+// Describe sends the descriptors of the collectors that are not disabled, so Collectors can be registered
+// with its metrics or embedded in a custom collector
+func (c *Collectors) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.all() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect sends the metrics of the collectors that are not disabled
+func (c *Collectors) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.all() {
+		collector.Collect(ch)
+	}
+}
+
+// Unregister removes the collectors from registerer. The middleware keeps recording
+// into them, but their metrics are no longer exposed, it should not be used afterwards.
+func (c *Collectors) Unregister(registerer prometheus.Registerer) {
+	for _, collector := range c.all() {
+		registerer.Unregister(collector)
+	}
+}
+
+// Reset removes every series recorded by the vectors and resets the in-flight high-water mark,
+// so tests can start from zero without creating the middleware again. It is intended for tests:
+// call it while no request is in flight, and note that ungrouped counters and gauges are kept.
+func (c *Collectors) Reset() {
+	for _, collector := range c.all() {
+		if vec, ok := collector.(interface{ Reset() }); ok {
+			vec.Reset()
+		}
+	}
+	c.requestsCache.reset()
+	c.durationCache.reset()
+}
+
+// Gather gathers the metrics from the gatherer of the middleware config
+func (c *Collectors) Gather() ([]*dto.MetricFamily, error) {
+	return c.gatherer.Gather()
+}
+
+// RequestCount returns the number of requests recorded with the status, method and handler labels,
+// summed over any other label. The status matches any of the status labels of the config StatusLabelMode.
+func (c *Collectors) RequestCount(status, method, handler string) (float64, error) {
+	if c.RequestsTotal == nil {
+		return 0, errors.New("requests counter is disabled")
+	}
+
+	mfs, err := c.Gather()
+	if err != nil {
+		return 0, err
+	}
+
+	var count float64
+	for _, mf := range mfs {
+		if mf.GetName() != c.requestsName {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if c.matchRequest(m, status, method, handler) {
+				count += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return count, nil
+}
+
+func (c *Collectors) matchRequest(m *dto.Metric, status, method, handler string) bool {
+	var statusMatch, methodMatch, handlerMatch bool
+	for _, label := range m.GetLabel() {
+		switch label.GetName() {
+		case c.methodLabelName:
+			methodMatch = label.GetValue() == method
+		case c.handlerLabelName:
+			handlerMatch = label.GetValue() == handler
+		default:
+			for _, name := range c.statusLabelNames {
+				if label.GetName() == name && label.GetValue() == status {
+					statusMatch = true
+				}
+			}
+		}
+	}
+	return statusMatch && methodMatch && handlerMatch
+}
+
+// Apdex returns the apdex score of every request recorded in the duration histogram, for a target
+// duration in the histogram unit. Requests are satisfied under target and tolerating under 4 times target.
+// As only bucket counts are known, each threshold is rounded down to the closest bucket boundary,
+// so the score is only as precise as the configured buckets.
+func (c *Collectors) Apdex(target float64) (float64, error) {
+	if c.RequestDuration == nil {
+		return 0, errors.New("duration histogram is disabled")
+	}
+
+	mfs, err := c.Gather()
+	if err != nil {
+		return 0, err
+	}
+
+	var satisfied, tolerating, total float64
+	for _, mf := range mfs {
+		if mf.GetName() != c.durationName {
+			continue
+		}
+		if mf.GetType() != dto.MetricType_HISTOGRAM {
+			return 0, errors.New("duration metric is not a histogram")
+		}
+		for _, m := range mf.GetMetric() {
+			h := m.GetHistogram()
+			total += float64(h.GetSampleCount())
+			s := cumulativeCount(h, target)
+			satisfied += s
+			tolerating += cumulativeCount(h, 4*target) - s
+		}
+	}
+	if total == 0 {
+		return 0, errors.New("no requests recorded")
+	}
+	return (satisfied + tolerating/2) / total, nil
+}
+
+// cumulativeCount returns the count of the largest bucket not greater than bound
+func cumulativeCount(h *dto.Histogram, bound float64) float64 {
+	var count float64
+	for _, b := range h.GetBucket() {
+		if b.GetUpperBound() > bound {
+			break
+		}
+		count = float64(b.GetCumulativeCount())
+	}
+	return count
+}
+
+// SetUp sets the app_up gauge to 1 when up and 0 otherwise, it does nothing when EnableUpGauge is not set
+func (c *Collectors) SetUp(up bool) {
+	if c.Up == nil {
+		return
+	}
+	if up {
+		c.Up.Set(1)
+	} else {
+		c.Up.Set(0)
+	}
+}
+
+// SetDown sets the app_up gauge to 0, like SetUp(false)
+func (c *Collectors) SetDown() {
+	c.SetUp(false)
+}
+
+// newBuildInfoGauge creates the build info gauge, its labels are constant
+func newBuildInfoGauge(config Config) prometheus.Gauge {
+	labels := prometheus.Labels{"go_version": runtime.Version()}
+	for name, value := range config.ConstLabels {
+		labels[name] = value
+	}
+	for name, value := range config.BuildInfo {
+		labels[name] = value
+	}
+
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   config.Namespace,
+		ConstLabels: labels,
+		Name:        buildInfo,
+		Help:        "Build information of the service, always 1",
+	})
+	g.Set(1)
+	return g
+}
+
+// inFlightTracker counts the requests in flight across all labels and exposes their high-water mark
+type inFlightTracker struct {
+	prometheus.GaugeFunc
+	current, max atomic.Int64
+}
+
+func newInFlightTracker(config Config) *inFlightTracker {
+	t := &inFlightTracker{}
+	t.GaugeFunc = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   config.Namespace,
+		Subsystem:   config.Subsystem,
+		ConstLabels: config.ConstLabels,
+		Name:        httpRequestsInFlightMax,
+		Help:        "Maximum number of HTTP requests processed concurrently since the start",
+	}, func() float64 {
+		return float64(t.max.Load())
+	})
+	return t
+}
+
+// inc adds a request in flight, raising the high-water mark when exceeded
+func (t *inFlightTracker) inc() {
+	n := t.current.Add(1)
+	for {
+		max := t.max.Load()
+		if n <= max || t.max.CompareAndSwap(max, n) {
+			return
+		}
+	}
+}
+
+func (t *inFlightTracker) dec() {
+	t.current.Add(-1)
+}
+
+// Reset lowers the high-water mark to the requests currently in flight
+func (t *inFlightTracker) Reset() {
+	t.max.Store(t.current.Load())
+}
@@ -0,0 +1,611 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConstLabels(t *testing.T) {
+	config, registry := newTestConfig()
+	config.ConstLabels = prometheus.Labels{"version": "1.2.3"}
+	config.EnableSizeMetrics = true
+	e, _ := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 {
+		t.Fatal("expected metrics to be gathered")
+	}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			found := false
+			for _, label := range m.GetLabel() {
+				found = found || label.GetName() == "version" && label.GetValue() == "1.2.3"
+			}
+			if !found {
+				t.Errorf("expected %s to have the version label, got %v", family.GetName(), m.GetLabel())
+			}
+		}
+	}
+}
+
+func TestDisableRequestCounterAndDurationHistogram(t *testing.T) {
+	for _, tc := range []struct {
+		disableCounter, disableHistogram bool
+	}{
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		config, registry := newTestConfig()
+		config.DisableRequestCounter = tc.disableCounter
+		config.DisableDurationHistogram = tc.disableHistogram
+		e, collectors := newTestServer(config)
+		if rec := serve(e, http.MethodGet, "/foo"); rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gathered := make(map[string]bool, len(families))
+		for _, family := range families {
+			gathered[family.GetName()] = true
+		}
+		if gathered["echo_http_requests_total"] == tc.disableCounter {
+			t.Errorf("%+v: expected the requests counter gathered to be %v", tc, !tc.disableCounter)
+		}
+		if gathered["echo_http_request_duration_seconds"] == tc.disableHistogram {
+			t.Errorf("%+v: expected the duration histogram gathered to be %v", tc, !tc.disableHistogram)
+		}
+		if (collectors.RequestsTotal == nil) != tc.disableCounter || (collectors.RequestDuration == nil) != tc.disableHistogram {
+			t.Errorf("%+v: expected disabled collectors not to be created", tc)
+		}
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	config, registry := newTestConfig()
+	config.EnableSizeMetrics = true
+	e, collectors := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+
+	collectors.Unregister(registry)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 0 {
+		t.Errorf("expected no metrics once unregistered, got %d families", len(families))
+	}
+
+	// a new middleware registers new collectors instead of reusing the unregistered ones
+	e, _ = newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 1 {
+		t.Errorf("expected the new middleware to start from 0, got %v", value)
+	}
+}
+
+// MetricsMiddleware keeps returning only the middleware
+var _ func() echo.MiddlewareFunc = MetricsMiddleware
+
+func TestCollectorsAssertable(t *testing.T) {
+	config, _ := newTestConfig()
+	e, collectors := newTestServer(config)
+	e.GET("/fail", func(c echo.Context) error {
+		return c.NoContent(http.StatusInternalServerError)
+	})
+
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/fail")
+
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo")); count != 2 {
+		t.Errorf("expected 2 successful requests, got %v", count)
+	}
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("5xx", "GET", "/fail")); count != 1 {
+		t.Errorf("expected 1 failed request, got %v", count)
+	}
+	if count := testutil.CollectAndCount(collectors.RequestDuration); count != 2 {
+		t.Errorf("expected 2 duration series, got %d", count)
+	}
+}
+
+func TestRequestsStarted(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableStartedCounter = true
+	e, collectors := newTestServer(config)
+	started := collectors.RequestsStarted.WithLabelValues("GET", "/slow")
+	completed := collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/slow")
+
+	serveBlocked(e, 2, func() {
+		if count := testutil.ToFloat64(started); count != 2 {
+			t.Errorf("expected 2 started requests, got %v", count)
+		}
+		if count := testutil.ToFloat64(completed); count != 0 {
+			t.Errorf("expected no completed request while blocked, got %v", count)
+		}
+	})
+	if count := testutil.ToFloat64(completed); count != 2 {
+		t.Errorf("expected 2 completed requests once served, got %v", count)
+	}
+}
+
+// gatheredHelp returns the help of each gathered metric family
+func gatheredHelp(t *testing.T, gatherer prometheus.Gatherer) map[string]string {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	help := make(map[string]string, len(families))
+	for _, family := range families {
+		help[family.GetName()] = family.GetHelp()
+	}
+	return help
+}
+
+func TestMetricNames(t *testing.T) {
+	config, registry := newTestConfig()
+	config.RequestsCounterName = "http_requests_count"
+	config.DurationHistogramName = "http_latency_seconds"
+	e, _ := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+
+	help := gatheredHelp(t, registry)
+	for _, name := range []string{"echo_http_http_requests_count", "echo_http_http_latency_seconds"} {
+		if _, ok := help[name]; !ok {
+			t.Errorf("expected %s to be gathered, got %v", name, help)
+		}
+	}
+	for _, name := range []string{"echo_http_requests_total", "echo_http_request_duration_seconds"} {
+		if _, ok := help[name]; ok {
+			t.Errorf("expected %s not to be gathered", name)
+		}
+	}
+
+	config.RequestsCounterName = "requests-total"
+	if err := config.Validate(); err == nil {
+		t.Error("expected an invalid requests counter name to be rejected")
+	}
+	config.RequestsCounterName = ""
+	config.DurationHistogramName = "1duration"
+	if err := config.Validate(); err == nil {
+		t.Error("expected an invalid duration histogram name to be rejected")
+	}
+}
+
+func TestMetricHelp(t *testing.T) {
+	for _, tc := range []struct {
+		requestsHelp, durationHelp string
+		expectedRequests           string
+		expectedDuration           string
+	}{
+		{"", "", "Number of HTTP requests processed", "Time spent processing HTTP requests"},
+		{"Requests served", "Latency of the requests", "Requests served", "Latency of the requests"},
+	} {
+		config, registry := newTestConfig()
+		config.RequestsCounterHelp = tc.requestsHelp
+		config.DurationHistogramHelp = tc.durationHelp
+		e, _ := newTestServer(config)
+		serve(e, http.MethodGet, "/foo")
+
+		help := gatheredHelp(t, registry)
+		if help["echo_http_requests_total"] != tc.expectedRequests {
+			t.Errorf("expected the requests counter help %q, got %q", tc.expectedRequests, help["echo_http_requests_total"])
+		}
+		if help["echo_http_request_duration_seconds"] != tc.expectedDuration {
+			t.Errorf("expected the duration help %q, got %q", tc.expectedDuration, help["echo_http_request_duration_seconds"])
+		}
+	}
+}
+
+func TestGatherAndRequestCount(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableContentTypeLabel = true
+	e, collectors := newStatusServer(config)
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/status/404")
+
+	families, err := collectors.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 {
+		t.Error("expected the recorded metrics to be gathered")
+	}
+
+	for _, tc := range []struct {
+		status, method, handler string
+		expected                float64
+	}{
+		{"2xx", "GET", "/foo", 2},
+		{"4xx", "GET", "/status/:code", 1},
+		{"5xx", "GET", "/foo", 0},
+		{"2xx", "POST", "/foo", 0},
+	} {
+		// summed over the content type label
+		if count, err := collectors.RequestCount(tc.status, tc.method, tc.handler); err != nil || count != tc.expected {
+			t.Errorf("expected %v %s %s %s requests, got %v, %v", tc.expected, tc.status, tc.method, tc.handler, count, err)
+		}
+	}
+
+	config, _ = newTestConfig()
+	config.StatusLabelMode = StatusLabelModeBoth
+	e, collectors = newStatusServer(config)
+	serve(e, http.MethodGet, "/status/404")
+	for _, status := range []string{"4xx", "404"} {
+		if count, err := collectors.RequestCount(status, "GET", "/status/:code"); err != nil || count != 1 {
+			t.Errorf("expected status %s to match, got %v, %v", status, count, err)
+		}
+	}
+
+	config, _ = newTestConfig()
+	config.DisableRequestCounter = true
+	_, collectors = newTestServer(config)
+	if _, err := collectors.RequestCount("2xx", "GET", "/foo"); err == nil {
+		t.Error("expected an error with the requests counter disabled")
+	}
+}
+
+func TestApdex(t *testing.T) {
+	config, _ := newTestConfig()
+	config.Buckets = []float64{0.1, 0.4, 1}
+	_, collectors := newTestServer(config)
+	if _, err := collectors.Apdex(0.1); err == nil {
+		t.Error("expected an error without requests")
+	}
+
+	// 2 satisfied, 1 tolerating and 2 frustrated requests over two series
+	for _, d := range []float64{0.05, 0.08, 0.3} {
+		collectors.RequestDuration.WithLabelValues("GET", "/foo").Observe(d)
+	}
+	for _, d := range []float64{0.9, 2} {
+		collectors.RequestDuration.WithLabelValues("GET", "/bar").Observe(d)
+	}
+	if apdex, err := collectors.Apdex(0.1); err != nil || apdex != 0.5 {
+		t.Errorf("expected an apdex of 0.5, got %v, %v", apdex, err)
+	}
+	// thresholds are rounded down to the buckets, 0.2 to 0.1 and 0.8 to 0.4
+	if apdex, err := collectors.Apdex(0.2); err != nil || apdex != 0.5 {
+		t.Errorf("expected an apdex of 0.5 with rounded thresholds, got %v, %v", apdex, err)
+	}
+
+	config, _ = newTestConfig()
+	config.DurationMetricType = DurationSummary
+	_, collectors = newTestServer(config)
+	collectors.RequestDuration.WithLabelValues("GET", "/foo").Observe(0.1)
+	if _, err := collectors.Apdex(0.1); err == nil {
+		t.Error("expected an error with a summary")
+	}
+}
+
+func TestLastRequestTimestamp(t *testing.T) {
+	for _, always := range []bool{false, true} {
+		clock := &fakeClock{now: time.Unix(1000, 0)}
+		config, _ := newTestConfig()
+		config.NowFunc = clock.Now
+		config.EnableLastRequestGauge = true
+		config.RecordTimestampAlways = always
+		config.Skipper = skipHealth
+		e, collectors := newTestServer(config)
+		e.GET("/health", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})
+
+		serve(e, http.MethodGet, "/foo")
+		serve(e, http.MethodGet, "/health")
+		foo := collectors.LastRequestTimestamp.WithLabelValues("GET", "/foo")
+		if value := testutil.ToFloat64(foo); value != 1000 {
+			t.Errorf("RecordTimestampAlways=%v: expected the last request at 1000, got %v", always, value)
+		}
+		clock.Advance(time.Minute)
+		serve(e, http.MethodGet, "/foo")
+		serve(e, http.MethodGet, "/health")
+		if value := testutil.ToFloat64(foo); value != 1060 {
+			t.Errorf("RecordTimestampAlways=%v: expected the gauge to advance to 1060, got %v", always, value)
+		}
+
+		health := 0.0
+		if always {
+			health = 1060
+		}
+		if value := testutil.ToFloat64(collectors.LastRequestTimestamp.WithLabelValues("GET", "/health")); value != health {
+			t.Errorf("RecordTimestampAlways=%v: expected the skipped request at %v, got %v", always, health, value)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	config, registry := newTestConfig()
+	config.BuildInfo = map[string]string{"version": "1.2.3", "commit": "abc123"}
+	newTestServer(config)
+
+	expected := `
+# HELP echo_build_info Build information of the service, always 1
+# TYPE echo_build_info gauge
+echo_build_info{commit="abc123",go_version="` + runtime.Version() + `",version="1.2.3"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "echo_build_info"); err != nil {
+		t.Error(err)
+	}
+
+	// go_version can be overridden
+	config, registry = newTestConfig()
+	config.BuildInfo = map[string]string{"go_version": "custom"}
+	newTestServer(config)
+	expected = `
+# HELP echo_build_info Build information of the service, always 1
+# TYPE echo_build_info gauge
+echo_build_info{go_version="custom"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "echo_build_info"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildInfoOptIn(t *testing.T) {
+	config, registry := newTestConfig()
+	newTestServer(config)
+	if _, ok := gatheredHelp(t, registry)["echo_build_info"]; ok {
+		t.Error("expected no build info without BuildInfo")
+	}
+}
+
+func TestRequestsInFlightMax(t *testing.T) {
+	const n = 8
+	config, _ := newTestConfig()
+	config.EnableInFlightMax = true
+	e, collectors := newTestServer(config)
+
+	serveBlocked(e, n, func() {
+		if value := testutil.ToFloat64(collectors.RequestsInFlightMax); value != n {
+			t.Errorf("expected a high-water mark of %d, got %v", n, value)
+		}
+	})
+	// the mark stays once the requests are served
+	serve(e, http.MethodGet, "/foo")
+	if value := testutil.ToFloat64(collectors.RequestsInFlightMax); value != n {
+		t.Errorf("expected the high-water mark to stay at %d, got %v", n, value)
+	}
+}
+
+func TestInFlightTrackerConcurrent(t *testing.T) {
+	tracker := newInFlightTracker(Config{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracker.inc()
+			tracker.dec()
+		}()
+	}
+	wg.Wait()
+
+	if max := tracker.max.Load(); max < 1 || max > 100 {
+		t.Errorf("expected a high-water mark between 1 and 100, got %d", max)
+	}
+	if current := tracker.current.Load(); current != 0 {
+		t.Errorf("expected no request in flight, got %d", current)
+	}
+}
+
+func TestCollectorsReset(t *testing.T) {
+	for _, cacheSeries := range []bool{false, true} {
+		config, registry := newTestConfig()
+		config.CacheSeries = cacheSeries
+		config.EnableInFlightMax = true
+		config.EnableErrorMetric = true
+		e, collectors := newTestServer(config)
+		serveBlocked(e, 4, func() {})
+		serve(e, http.MethodGet, "/foo")
+
+		collectors.Reset()
+		for name, count := range map[string]int{
+			"requests":  testutil.CollectAndCount(collectors.RequestsTotal),
+			"durations": testutil.CollectAndCount(collectors.RequestDuration),
+			"errors":    testutil.CollectAndCount(collectors.Errors),
+		} {
+			if count != 0 {
+				t.Errorf("CacheSeries=%v: expected no %s series after Reset, got %d", cacheSeries, name, count)
+			}
+		}
+		if value := testutil.ToFloat64(collectors.RequestsInFlightMax); value != 0 {
+			t.Errorf("CacheSeries=%v: expected the high-water mark to be reset, got %v", cacheSeries, value)
+		}
+
+		// the same middleware records again from zero
+		serve(e, http.MethodGet, "/foo")
+		if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 1 {
+			t.Errorf("CacheSeries=%v: expected 1 request after Reset, got %v", cacheSeries, value)
+		}
+		if count := sampleCount(t, registry, "echo_http_request_duration_seconds"); count != 1 {
+			t.Errorf("CacheSeries=%v: expected 1 duration after Reset, got %d", cacheSeries, count)
+		}
+		if value := testutil.ToFloat64(collectors.RequestsInFlightMax); value != 1 {
+			t.Errorf("CacheSeries=%v: expected a high-water mark of 1 after Reset, got %v", cacheSeries, value)
+		}
+	}
+}
+
+func TestLabelNames(t *testing.T) {
+	config, registry := newTestConfig()
+	config.StatusLabelName = "code"
+	config.MethodLabelName = "verb"
+	config.HandlerLabelName = "route"
+	e, collectors := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+
+	expected := `
+# HELP echo_http_requests_total Number of HTTP requests processed
+# TYPE echo_http_requests_total counter
+echo_http_requests_total{code="2xx",route="/foo",verb="GET"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "echo_http_requests_total"); err != nil {
+		t.Error(err)
+	}
+	if count, err := collectors.RequestCount("2xx", "GET", "/foo"); err != nil || count != 1 {
+		t.Errorf("expected RequestCount to follow the label names, got %v, %v", count, err)
+	}
+
+	for _, name := range []string{"status-code", "__method", "1handler"} {
+		config := NewConfig()
+		config.StatusLabelName = name
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected the label name %q to be rejected", name)
+		}
+	}
+}
+
+func TestSLOViolations(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config, _ := newTestConfig()
+	config.NowFunc = clock.Now
+	config.SLOThreshold = 500 * time.Millisecond
+	e, collectors := newTestServer(config)
+	e.GET("/slow", func(c echo.Context) error {
+		clock.Advance(time.Second)
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/fast", func(c echo.Context) error {
+		clock.Advance(100 * time.Millisecond)
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/limit", func(c echo.Context) error {
+		clock.Advance(500 * time.Millisecond)
+		return c.NoContent(http.StatusOK)
+	})
+	for _, target := range []string{"/slow", "/slow", "/fast", "/limit"} {
+		serve(e, http.MethodGet, target)
+	}
+
+	if count := testutil.ToFloat64(collectors.SLOViolations.WithLabelValues("GET", "/slow")); count != 2 {
+		t.Errorf("expected 2 violations for the slow handler, got %v", count)
+	}
+	// only the slow handler has a series, a duration equal to the threshold is within the SLO
+	if count := testutil.CollectAndCount(collectors.SLOViolations); count != 1 {
+		t.Errorf("expected only the slow handler to violate the SLO, got %d series", count)
+	}
+}
+
+func TestLastRequestDuration(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config, _ := newTestConfig()
+	config.NowFunc = clock.Now
+	config.EnableLastDurationGauge = true
+	e, collectors := newTestServer(config)
+	var took time.Duration
+	e.GET("/work", func(c echo.Context) error {
+		clock.Advance(took)
+		return c.NoContent(http.StatusOK)
+	})
+
+	gauge := collectors.LastRequestDuration.WithLabelValues("GET", "/work")
+	for _, d := range []time.Duration{2 * time.Second, 250 * time.Millisecond, time.Second} {
+		took = d
+		serve(e, http.MethodGet, "/work")
+		if value := testutil.ToFloat64(gauge); value != d.Seconds() {
+			t.Errorf("expected the last duration to be %v, got %vs", d, value)
+		}
+	}
+}
+
+// customCollector embeds the middleware collectors with a metric of its own
+type customCollector struct {
+	*Collectors
+	extra prometheus.Gauge
+}
+
+func (c customCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.Collectors.Describe(ch)
+	c.extra.Describe(ch)
+}
+
+func (c customCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Collectors.Collect(ch)
+	c.extra.Collect(ch)
+}
+
+func TestUnregisteredMetricsMiddleware(t *testing.T) {
+	config, ignored := newTestConfig()
+	metrics, collectors, err := UnregisteredMetricsMiddleware(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(metrics)
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/foo")
+
+	if families, err := ignored.Gather(); err != nil || len(families) != 0 {
+		t.Fatalf("expected the config registerer to be ignored, got %d families, %v", len(families), err)
+	}
+	if count, err := collectors.RequestCount("2xx", "GET", "/foo"); err != nil || count != 1 {
+		t.Errorf("expected Collectors to gather its own metrics, got %v, %v", count, err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(customCollector{collectors, prometheus.NewGauge(prometheus.GaugeOpts{Name: "custom"})})
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 1 {
+		t.Errorf("expected the request to be exposed by the custom collector, got %v", value)
+	}
+	if n := seriesCount(t, registry, "custom"); n != 1 {
+		t.Errorf("expected the custom metric to be exposed, got %d series", n)
+	}
+	// registered twice, the collectors clash with themselves
+	if err := registry.Register(collectors); err == nil {
+		t.Error("expected registering the collectors again to fail")
+	}
+}
+
+func TestUpGauge(t *testing.T) {
+	config, registry := newTestConfig()
+	config.EnableUpGauge = true
+	_, collectors := newTestServer(config)
+
+	for _, tc := range []struct {
+		toggle   func()
+		expected float64
+	}{
+		{func() {}, 0},
+		{func() { collectors.SetUp(true) }, 1},
+		{collectors.SetDown, 0},
+		{func() { collectors.SetUp(true) }, 1},
+		{func() { collectors.SetUp(false) }, 0},
+	} {
+		tc.toggle()
+		if value := testutil.ToFloat64(collectors.Up); value != tc.expected {
+			t.Errorf("expected app_up to be %v, got %v", tc.expected, value)
+		}
+	}
+	// the gauge is only namespaced
+	if n := seriesCount(t, registry, "echo_app_up"); n != 1 {
+		t.Errorf("expected the echo_app_up gauge to be registered, got %d series", n)
+	}
+
+	// toggling a disabled gauge does nothing
+	config, registry = newTestConfig()
+	_, collectors = newTestServer(config)
+	collectors.SetUp(true)
+	collectors.SetDown()
+	if n := seriesCount(t, registry, "echo_app_up"); n != 0 {
+		t.Errorf("expected no app_up gauge, got %d series", n)
+	}
+}
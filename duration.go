@@ -0,0 +1,367 @@
+package echoprometheus
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultNativeHistogramBucketFactor     = 1.1
+	defaultNativeHistogramMaxBucketNumber  = 160
+	defaultNativeHistogramMinResetDuration = time.Hour
+)
+
+// DurationMetricType defines the kind of metric recording the request duration
+type DurationMetricType int
+
+const (
+	// DurationHistogram records the duration in a histogram using Buckets
+	DurationHistogram DurationMetricType = iota
+	// DurationSummary records the duration in a summary using Objectives.
+	// Summary quantiles are computed by each instance and can't be aggregated across instances.
+	DurationSummary
+)
+
+// DurationUnit defines the unit of the request duration metric
+type DurationUnit int
+
+const (
+	// DurationSeconds records the duration in seconds, as recommended by prometheus
+	DurationSeconds DurationUnit = iota
+	// DurationMilliseconds records the duration in milliseconds
+	DurationMilliseconds
+)
+
+// metricName returns the duration metric name with the unit suffix
+func (u DurationUnit) metricName() string {
+	if u == DurationMilliseconds {
+		return httpRequestsDurationMs
+	}
+	return httpRequestsDuration
+}
+
+// buckets converts buckets in seconds to the unit
+func (u DurationUnit) buckets(seconds []float64) []float64 {
+	if u == DurationMilliseconds {
+		return scaleBuckets(seconds, 1000)
+	}
+	return seconds
+}
+
+// seconds converts buckets in the unit to seconds
+func (u DurationUnit) seconds(buckets []float64) []float64 {
+	if u == DurationMilliseconds {
+		return scaleBuckets(buckets, 1.0/1000)
+	}
+	return buckets
+}
+
+// value converts d to the unit
+func (u DurationUnit) value(d time.Duration) float64 {
+	if u == DurationMilliseconds {
+		return float64(d) / float64(time.Millisecond)
+	}
+	return d.Seconds()
+}
+
+// newDurationCollector returns the collector recording the request duration, according to the config metric type
+func newDurationCollector(config Config, labelNames []string) prometheus.ObserverVec {
+	if config.MethodAsMetricSuffix {
+		return newMethodSuffixVec(config, labelNames)
+	}
+
+	if config.DurationMetricType == DurationSummary {
+		return prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace:   config.Namespace,
+			Subsystem:   config.Subsystem,
+			ConstLabels: config.ConstLabels,
+			Name:        config.DurationHistogramName,
+			Help:        config.DurationHistogramHelp,
+			Objectives:  config.Objectives,
+			MaxAge:      config.SummaryMaxAge,
+			AgeBuckets:  uint32(config.SummaryAgeBuckets),
+		}, labelNames)
+	}
+
+	opts := prometheus.HistogramOpts{
+		Namespace:   config.Namespace,
+		Subsystem:   config.Subsystem,
+		ConstLabels: config.ConstLabels,
+		Name:        config.DurationHistogramName,
+		Help:        config.DurationHistogramHelp,
+		Buckets:     config.Buckets,
+	}
+	if config.NativeHistogram {
+		opts.NativeHistogramBucketFactor = config.NativeHistogramBucketFactor
+		opts.NativeHistogramMaxBucketNumber = config.NativeHistogramMaxBucketNumber
+		opts.NativeHistogramMinResetDuration = config.NativeHistogramMinResetDuration
+		if config.DisableClassicBuckets {
+			opts.Buckets = nil
+		}
+	}
+	if len(config.BucketsPerHandler) == 0 {
+		return prometheus.NewHistogramVec(opts, labelNames)
+	}
+
+	vec := &handlerBucketsVec{
+		HistogramVec: prometheus.NewHistogramVec(opts, labelNames),
+		handlerLabel: config.HandlerLabelName,
+		handlers:     make(map[string]*prometheus.HistogramVec, len(config.BucketsPerHandler)),
+	}
+	for i, name := range labelNames {
+		if name == config.HandlerLabelName {
+			vec.handlerIndex = i
+		}
+	}
+	for handler, buckets := range config.BucketsPerHandler {
+		handlerOpts := opts
+		// like Buckets, empty handler buckets fall back to the default ones
+		if len(buckets) > 0 {
+			handlerOpts.Buckets = buckets
+		}
+		vec.handlers[handler] = prometheus.NewHistogramVec(handlerOpts, labelNames)
+	}
+	return vec
+}
+
+// handlerBucketsVec routes the observations of some handlers to histograms with their own buckets.
+// All of them share the same descriptor, so they are collected as a single metric family
+// whose series have different buckets depending on the handler.
+type handlerBucketsVec struct {
+	*prometheus.HistogramVec
+	handlerLabel string
+	handlerIndex int
+	handlers     map[string]*prometheus.HistogramVec
+}
+
+func (v *handlerBucketsVec) vecFor(handler string) *prometheus.HistogramVec {
+	if vec, ok := v.handlers[handler]; ok {
+		return vec
+	}
+	return v.HistogramVec
+}
+
+func (v *handlerBucketsVec) Collect(ch chan<- prometheus.Metric) {
+	v.HistogramVec.Collect(ch)
+	for _, vec := range v.handlers {
+		vec.Collect(ch)
+	}
+}
+
+func (v *handlerBucketsVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Observer, error) {
+	if len(lvs) <= v.handlerIndex {
+		return v.HistogramVec.GetMetricWithLabelValues(lvs...)
+	}
+	return v.vecFor(lvs[v.handlerIndex]).GetMetricWithLabelValues(lvs...)
+}
+
+func (v *handlerBucketsVec) GetMetricWith(labels prometheus.Labels) (prometheus.Observer, error) {
+	return v.vecFor(labels[v.handlerLabel]).GetMetricWith(labels)
+}
+
+func (v *handlerBucketsVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	o, err := v.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+func (v *handlerBucketsVec) With(labels prometheus.Labels) prometheus.Observer {
+	o, err := v.GetMetricWith(labels)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+// CurryWith only curries the default histogram, observations of curried vectors
+// don't use the per handler buckets
+func (v *handlerBucketsVec) CurryWith(labels prometheus.Labels) (prometheus.ObserverVec, error) {
+	return v.HistogramVec.CurryWith(labels)
+}
+
+func (v *handlerBucketsVec) MustCurryWith(labels prometheus.Labels) prometheus.ObserverVec {
+	return v.HistogramVec.MustCurryWith(labels)
+}
+
+// Reset deletes all the series of every histogram
+func (v *handlerBucketsVec) Reset() {
+	v.HistogramVec.Reset()
+	for _, vec := range v.handlers {
+		vec.Reset()
+	}
+}
+
+// DeletePartialMatch deletes the matching series of every handler histogram
+func (v *handlerBucketsVec) DeletePartialMatch(labels prometheus.Labels) int {
+	deleted := v.HistogramVec.DeletePartialMatch(labels)
+	for _, vec := range v.handlers {
+		deleted += vec.DeletePartialMatch(labels)
+	}
+	return deleted
+}
+
+// methodSuffixVec routes the observations of each method to its own duration metric, named with
+// the method before the unit suffix and without method label. The method label value must be the first one.
+type methodSuffixVec struct {
+	methodLabel string
+	methods     map[string]prometheus.ObserverVec
+}
+
+func newMethodSuffixVec(config Config, labelNames []string) *methodSuffixVec {
+	methods := config.AllowedMethods
+	if len(methods) == 0 {
+		methods = standardMethods
+	}
+
+	vec := &methodSuffixVec{
+		methodLabel: labelNames[0],
+		methods:     make(map[string]prometheus.ObserverVec, len(methods)+1),
+	}
+	methodConfig := config
+	methodConfig.MethodAsMetricSuffix = false
+	for _, method := range append(methods[:len(methods):len(methods)], otherMethod) {
+		methodConfig.DurationHistogramName = methodMetricName(config.DurationHistogramName, method)
+		vec.methods[method] = newDurationCollector(methodConfig, labelNames[1:])
+	}
+	return vec
+}
+
+// methodMetricName inserts the lowercased method before the unit suffix of name
+func methodMetricName(name, method string) string {
+	method = strings.ToLower(invalidMetricNameChars.ReplaceAllString(method, "_"))
+	for _, unit := range []string{"_seconds", "_milliseconds"} {
+		if strings.HasSuffix(name, unit) {
+			return strings.TrimSuffix(name, unit) + "_" + method + unit
+		}
+	}
+	return name + "_" + method
+}
+
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func (v *methodSuffixVec) Describe(ch chan<- *prometheus.Desc) {
+	for _, vec := range v.methods {
+		vec.Describe(ch)
+	}
+}
+
+func (v *methodSuffixVec) Collect(ch chan<- prometheus.Metric) {
+	for _, vec := range v.methods {
+		vec.Collect(ch)
+	}
+}
+
+func (v *methodSuffixVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Observer, error) {
+	if len(lvs) == 0 {
+		return nil, errors.New("missing method label value")
+	}
+	vec, ok := v.methods[lvs[0]]
+	if !ok {
+		return nil, fmt.Errorf("no duration metric for method %q", lvs[0])
+	}
+	return vec.GetMetricWithLabelValues(lvs[1:]...)
+}
+
+func (v *methodSuffixVec) GetMetricWith(labels prometheus.Labels) (prometheus.Observer, error) {
+	vec, ok := v.methods[labels[v.methodLabel]]
+	if !ok {
+		return nil, fmt.Errorf("no duration metric for method %q", labels[v.methodLabel])
+	}
+	methodLabels := make(prometheus.Labels, len(labels))
+	for name, value := range labels {
+		if name != v.methodLabel {
+			methodLabels[name] = value
+		}
+	}
+	return vec.GetMetricWith(methodLabels)
+}
+
+func (v *methodSuffixVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	o, err := v.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+func (v *methodSuffixVec) With(labels prometheus.Labels) prometheus.Observer {
+	o, err := v.GetMetricWith(labels)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+// CurryWith is not supported, the metrics of each method are separate
+func (v *methodSuffixVec) CurryWith(prometheus.Labels) (prometheus.ObserverVec, error) {
+	return nil, errors.New("curried duration metrics are not supported with MethodAsMetricSuffix")
+}
+
+func (v *methodSuffixVec) MustCurryWith(labels prometheus.Labels) prometheus.ObserverVec {
+	vec, err := v.CurryWith(labels)
+	if err != nil {
+		panic(err)
+	}
+	return vec
+}
+
+// DeletePartialMatch deletes the matching series of every method, the method label is matched by metric
+func (v *methodSuffixVec) DeletePartialMatch(labels prometheus.Labels) int {
+	var deleted int
+	for method, vec := range v.methods {
+		methodLabels := make(prometheus.Labels, len(labels))
+		for name, value := range labels {
+			if name != v.methodLabel {
+				methodLabels[name] = value
+			} else if value != method {
+				methodLabels = nil
+				break
+			}
+		}
+		if d, ok := vec.(interface{ DeletePartialMatch(prometheus.Labels) int }); ok && methodLabels != nil {
+			deleted += d.DeletePartialMatch(methodLabels)
+		}
+	}
+	return deleted
+}
+
+// Reset deletes all the series of every method
+func (v *methodSuffixVec) Reset() {
+	for _, vec := range v.methods {
+		if r, ok := vec.(interface{ Reset() }); ok {
+			r.Reset()
+		}
+	}
+}
+
+// observe records value with the exemplar when there is one and the observer supports it.
+// Invalid exemplars, which ObserveWithExemplar panics on, are dropped.
+func observe(observer prometheus.Observer, value float64, exemplar prometheus.Labels) {
+	if len(exemplar) > 0 && validExemplar(exemplar) {
+		if eo, ok := observer.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(value, exemplar)
+			return
+		}
+	}
+	observer.Observe(value)
+}
+
+// validExemplar reports whether labels have valid names and UTF-8 values, within ExemplarMaxRunes
+func validExemplar(labels prometheus.Labels) bool {
+	var runes int
+	for name, value := range labels {
+		if !validLabelName(name) || !utf8.ValidString(value) {
+			return false
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	return runes <= prometheus.ExemplarMaxRunes
+}
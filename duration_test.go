@@ -0,0 +1,480 @@
+package echoprometheus
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestDurationExcludesErrorHandler(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config, registry := newTestConfig()
+	config.NowFunc = clock.Now
+	e, _ := newTestServer(config)
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		// a slow error rendering
+		clock.Advance(10 * time.Second)
+		_ = c.NoContent(http.StatusInternalServerError)
+	}
+	e.GET("/fail", func(c echo.Context) error {
+		clock.Advance(time.Second)
+		return errors.New("failed")
+	})
+
+	if rec := serve(e, http.MethodGet, "/fail"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", rec.Code)
+	}
+	if sum := sampleSum(t, registry, "echo_http_request_duration_seconds"); sum != 1 {
+		t.Errorf("expected the 1s of the handler only, got %vs", sum)
+	}
+}
+
+// durationFamily returns the gathered request duration metric family
+func durationFamily(t *testing.T, g prometheus.Gatherer) *dto.MetricFamily {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "echo_http_request_duration_seconds" {
+			return family
+		}
+	}
+	t.Fatal("expected the request duration to be gathered")
+	return nil
+}
+
+func TestDurationMetricType(t *testing.T) {
+	for _, tc := range []struct {
+		metricType DurationMetricType
+		objectives map[float64]float64
+		expected   dto.MetricType
+		quantiles  []float64
+	}{
+		{DurationHistogram, nil, dto.MetricType_HISTOGRAM, nil},
+		{DurationSummary, nil, dto.MetricType_SUMMARY, []float64{0.5, 0.9, 0.99}},
+		{DurationSummary, map[float64]float64{0.75: 0.01}, dto.MetricType_SUMMARY, []float64{0.75}},
+	} {
+		config, registry := newTestConfig()
+		config.DurationMetricType = tc.metricType
+		config.Objectives = tc.objectives
+		e, _ := newTestServer(config)
+		serve(e, http.MethodGet, "/foo")
+		serve(e, http.MethodGet, "/foo")
+
+		family := durationFamily(t, registry)
+		if family.GetType() != tc.expected {
+			t.Errorf("type %d: expected a %v, got %v", tc.metricType, tc.expected, family.GetType())
+			continue
+		}
+		if count := sampleCount(t, registry, family.GetName()); count != 2 {
+			t.Errorf("type %d: expected 2 observations, got %d", tc.metricType, count)
+		}
+		if tc.expected != dto.MetricType_SUMMARY {
+			continue
+		}
+		var quantiles []float64
+		for _, q := range family.GetMetric()[0].GetSummary().GetQuantile() {
+			quantiles = append(quantiles, q.GetQuantile())
+		}
+		if !reflect.DeepEqual(quantiles, tc.quantiles) {
+			t.Errorf("type %d: expected quantiles %v, got %v", tc.metricType, tc.quantiles, quantiles)
+		}
+	}
+}
+
+func TestSummaryWindow(t *testing.T) {
+	const maxAge = 50 * time.Millisecond
+	for _, tc := range []struct {
+		maxAge  time.Duration
+		expired bool
+	}{
+		{0, false},
+		{maxAge, true},
+	} {
+		config, registry := newTestConfig()
+		config.DurationMetricType = DurationSummary
+		config.SummaryMaxAge = tc.maxAge
+		config.SummaryAgeBuckets = 2
+		e, _ := newTestServer(config)
+		serve(e, http.MethodGet, "/foo")
+		time.Sleep(2 * maxAge)
+
+		// the quantiles forget the observations older than the window, the count keeps them
+		summary := durationFamily(t, registry).GetMetric()[0].GetSummary()
+		if summary.GetSampleCount() != 1 {
+			t.Errorf("max age %v: expected 1 observation, got %d", tc.maxAge, summary.GetSampleCount())
+		}
+		if expired := math.IsNaN(summary.GetQuantile()[0].GetValue()); expired != tc.expired {
+			t.Errorf("max age %v: expected the observation expired %v, got %v", tc.maxAge, tc.expired, expired)
+		}
+	}
+}
+
+// scrapeProtobuf scrapes the metrics of registry in the protobuf format and returns the request duration family
+func scrapeProtobuf(t *testing.T, registry *prometheus.Registry) *dto.MetricFamily {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+	rec := httptest.NewRecorder()
+	if err := MetricsHandlerWithConfig(Config{Registerer: registry})(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := expfmt.NewDecoder(rec.Body, expfmt.ResponseFormat(rec.Header()))
+	for {
+		var family dto.MetricFamily
+		if err := decoder.Decode(&family); err != nil {
+			t.Fatalf("expected the request duration to be scraped: %v", err)
+		}
+		if family.GetName() == "echo_http_request_duration_seconds" {
+			return &family
+		}
+	}
+}
+
+func TestNativeHistogram(t *testing.T) {
+	for _, disableClassic := range []bool{false, true} {
+		config, registry := newTestConfig()
+		config.NativeHistogram = true
+		config.DisableClassicBuckets = disableClassic
+		config.NowFunc = (&fakeClock{now: time.Unix(0, 0)}).Now
+		e, _ := newTestServer(config)
+		serve(e, http.MethodGet, "/foo")
+
+		h := scrapeProtobuf(t, registry).GetMetric()[0].GetHistogram()
+		// the default bucket factor of 1.1 is schema 3, the largest growth factor below it being 2^(2^-3)
+		if h.GetSchema() != 3 {
+			t.Errorf("DisableClassicBuckets=%v: expected native histogram schema 3, got %v", disableClassic, h)
+		}
+		if h.GetZeroCount() != 1 {
+			t.Errorf("DisableClassicBuckets=%v: expected the 0s observation in the zero bucket, got %d", disableClassic, h.GetZeroCount())
+		}
+		if classic := len(h.GetBucket()) > 0; classic == disableClassic {
+			t.Errorf("DisableClassicBuckets=%v: expected classic buckets to be emitted: %v, got %d buckets", disableClassic, !disableClassic, len(h.GetBucket()))
+		}
+	}
+}
+
+func TestExemplarExposedInOpenMetrics(t *testing.T) {
+	config, _ := newTestConfig()
+	config.ExemplarFunc = func(c echo.Context) prometheus.Labels {
+		return prometheus.Labels{"trace_id": "abc123"}
+	}
+
+	e := echo.New()
+	e.Use(MetricsMiddlewareWithConfig(config))
+	e.GET("/metrics", MetricsHandlerWithConfig(config))
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/foo")
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatalf("expected an OpenMetrics response, got %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), `# {trace_id="abc123"}`) {
+		t.Errorf("expected the trace_id exemplar in the scrape, got:\n%s", rec.Body.String())
+	}
+}
+
+func TestObserveDropsInvalidExemplars(t *testing.T) {
+	exemplars := map[string]prometheus.Labels{
+		"too long":       {"trace_id": strings.Repeat("a", prometheus.ExemplarMaxRunes)},
+		"invalid utf8":   {"trace_id": "\xff"},
+		"invalid name":   {"trace-id": "abc"},
+		"reserved name":  {"__trace_id": "abc"},
+		"valid exemplar": {"trace_id": "abc"},
+	}
+	for name, exemplar := range exemplars {
+		t.Run(name, func(t *testing.T) {
+			histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_duration_seconds"})
+			observe(histogram, 1, exemplar)
+			if count := testutil.CollectAndCount(histogram); count != 1 {
+				t.Fatalf("expected one histogram, got %d", count)
+			}
+			if !strings.Contains(histogramString(t, histogram), "sample_count:1") {
+				t.Errorf("expected the observation to be recorded")
+			}
+		})
+	}
+}
+
+// histogramString returns the text representation of the histogram metric
+func histogramString(t *testing.T, histogram prometheus.Histogram) string {
+	t.Helper()
+	var m dto.Metric
+	if err := histogram.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.String()
+}
+
+func TestNowFuncObservesExactDuration(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config, registry := newTestConfig()
+	config.NowFunc = clock.Now
+	e, _ := newTestServer(config)
+	e.GET("/slow", func(c echo.Context) error {
+		clock.Advance(250 * time.Millisecond)
+		return c.NoContent(http.StatusOK)
+	})
+
+	serve(e, http.MethodGet, "/slow")
+	if sum := sampleSum(t, registry, "echo_http_request_duration_seconds"); sum != 0.25 {
+		t.Errorf("expected a 0.25s observation, got %vs", sum)
+	}
+	buckets, counts := histogramBuckets(t, registry, "echo_http_request_duration_seconds")
+	for i, bucket := range buckets {
+		expected := uint64(0)
+		if bucket >= 0.25 {
+			expected = 1
+		}
+		if counts[i] != expected {
+			t.Errorf("expected %d cumulative observations in the %v bucket, got %d", expected, bucket, counts[i])
+		}
+	}
+}
+
+func TestBucketsPerHandler(t *testing.T) {
+	fast, slow := []float64{0.001, 0.01}, []float64{1, 10, 60}
+	config, registry := newTestConfig()
+	config.BucketsPerHandler = map[string][]float64{"/foo": fast, "/slow": slow}
+	e, _ := newTestServer(config)
+	e.GET("/slow", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/default", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	for _, target := range []string{"/foo", "/slow", "/default"} {
+		serve(e, http.MethodGet, target)
+	}
+
+	buckets := make(map[string][]float64)
+	for _, m := range durationFamily(t, registry).GetMetric() {
+		var handler string
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "handler" {
+				handler = label.GetValue()
+			}
+		}
+		for _, b := range m.GetHistogram().GetBucket() {
+			buckets[handler] = append(buckets[handler], b.GetUpperBound())
+		}
+	}
+	expected := map[string][]float64{"/foo": fast, "/slow": slow, "/default": DefaultBuckets()}
+	if !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("expected buckets %v, got %v", expected, buckets)
+	}
+}
+
+// histogramBuckets returns the upper bounds and cumulative counts of the first series
+// of the histogram named name
+func histogramBuckets(t *testing.T, gatherer prometheus.Gatherer, name string) ([]float64, []uint64) {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name || len(family.GetMetric()) == 0 {
+			continue
+		}
+		var bounds []float64
+		var counts []uint64
+		for _, b := range family.GetMetric()[0].GetHistogram().GetBucket() {
+			bounds = append(bounds, b.GetUpperBound())
+			counts = append(counts, b.GetCumulativeCount())
+		}
+		return bounds, counts
+	}
+	t.Fatalf("no %s series", name)
+	return nil, nil
+}
+
+func TestMillisecondsDefaultBuckets(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	registry := prometheus.NewRegistry()
+	config := Config{
+		Namespace:    "echo",
+		Subsystem:    "http",
+		Registerer:   registry,
+		DurationUnit: DurationMilliseconds,
+		EnableTTFB:   true,
+		NowFunc:      clock.Now,
+	}
+
+	e := echo.New()
+	e.Use(MetricsMiddlewareWithConfig(config))
+	e.GET("/foo", func(c echo.Context) error {
+		clock.Advance(50 * time.Millisecond)
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/foo")
+
+	bounds, counts := histogramBuckets(t, registry, "echo_http_request_duration_milliseconds")
+	for i, bound := range bounds {
+		if bound == 50 {
+			if counts[i] != 1 {
+				t.Errorf("expected the 50ms request in the 50 bucket, got %d", counts[i])
+			}
+			break
+		}
+		if i == len(bounds)-1 {
+			t.Fatalf("expected the default buckets in milliseconds, got %v", bounds)
+		}
+	}
+
+	ttfbBounds, _ := histogramBuckets(t, registry, "echo_http_time_to_first_byte_seconds")
+	if ttfbBounds[len(ttfbBounds)-1] != 30 {
+		t.Errorf("expected the time to first byte buckets in seconds, got %v", ttfbBounds)
+	}
+}
+
+func TestMillisecondsNewConfigBuckets(t *testing.T) {
+	// NewConfig leaves the buckets empty, so they follow the unit set afterwards
+	config, registry := newTestConfig()
+	config.DurationUnit = DurationMilliseconds
+	config.EnableTTFB = true
+	e, _ := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+
+	bounds, _ := histogramBuckets(t, registry, "echo_http_request_duration_milliseconds")
+	if bounds[0] != 0.5 || bounds[len(bounds)-1] != 30000 {
+		t.Errorf("expected the default buckets in milliseconds, got %v", bounds)
+	}
+	ttfbBounds, _ := histogramBuckets(t, registry, "echo_http_time_to_first_byte_seconds")
+	if !reflect.DeepEqual(ttfbBounds, DefaultBuckets()) {
+		t.Errorf("expected the default buckets in seconds for the time to first byte, got %v", ttfbBounds)
+	}
+}
+
+func TestMillisecondsBucketsConvertedForSecondsHistograms(t *testing.T) {
+	config, registry := newTestConfig()
+	config.DurationUnit = DurationMilliseconds
+	config.Buckets = []float64{10, 100, 1000}
+	config.EnableTTFB = true
+	e, _ := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+
+	bounds, _ := histogramBuckets(t, registry, "echo_http_request_duration_milliseconds")
+	if len(bounds) != 3 || bounds[0] != 10 || bounds[2] != 1000 {
+		t.Errorf("expected the configured buckets for the duration, got %v", bounds)
+	}
+	ttfbBounds, _ := histogramBuckets(t, registry, "echo_http_time_to_first_byte_seconds")
+	if len(ttfbBounds) != 3 || ttfbBounds[0] != 0.01 || ttfbBounds[2] != 1 {
+		t.Errorf("expected the buckets in seconds for the time to first byte, got %v", ttfbBounds)
+	}
+}
+
+func TestEmptyBuckets(t *testing.T) {
+	valid := []float64{0.1, 1}
+	for name, tc := range map[string]struct{ buckets, expected []float64 }{
+		"nil":   {nil, DefaultBuckets()},
+		"empty": {[]float64{}, DefaultBuckets()},
+		"valid": {valid, valid},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, registry := newTestConfig()
+			config.Buckets = tc.buckets
+			config.BucketsPerHandler = map[string][]float64{"/empty": {}}
+			e, _ := newTestServer(config)
+			e.GET("/empty", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+			serve(e, http.MethodGet, "/foo")
+			serve(e, http.MethodGet, "/empty")
+
+			for _, m := range durationFamily(t, registry).GetMetric() {
+				var bounds []float64
+				for _, b := range m.GetHistogram().GetBucket() {
+					bounds = append(bounds, b.GetUpperBound())
+				}
+				if !reflect.DeepEqual(bounds, tc.expected) {
+					t.Errorf("expected buckets %v for %v, got %v", tc.expected, m.GetLabel(), bounds)
+				}
+			}
+		})
+	}
+}
+
+func TestMethodAsMetricSuffix(t *testing.T) {
+	config, registry := newTestConfig()
+	config.MethodAsMetricSuffix = true
+	config.AllowedMethods = []string{http.MethodGet, http.MethodPost}
+	config.BucketsPerHandler = map[string][]float64{"/foo": {1}}
+	e, _ := newTestServer(config)
+	e.POST("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	e.DELETE("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodPost, "/foo")
+	serve(e, http.MethodDelete, "/foo")
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]uint64)
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "echo_http_request_duration") {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "method" {
+					t.Errorf("expected no method label on %s", family.GetName())
+				}
+			}
+			if buckets := m.GetHistogram().GetBucket(); len(buckets) != 1 || buckets[0].GetUpperBound() != 1 {
+				t.Errorf("expected the /foo buckets on %s, got %v", family.GetName(), buckets)
+			}
+			counts[family.GetName()] += m.GetHistogram().GetSampleCount()
+		}
+	}
+	expected := map[string]uint64{
+		"echo_http_request_duration_get_seconds":   2,
+		"echo_http_request_duration_post_seconds":  1,
+		"echo_http_request_duration_other_seconds": 1,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected the durations %v, got %v", expected, counts)
+	}
+}
+
+func TestMethodMetricName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"request_duration_seconds":      "request_duration_get_seconds",
+		"request_duration_milliseconds": "request_duration_get_milliseconds",
+		"request_duration":              "request_duration_get",
+	} {
+		if got := methodMetricName(name, http.MethodGet); got != expected {
+			t.Errorf("expected %s for %s, got %s", expected, name, got)
+		}
+	}
+	if got := methodMetricName("request_duration_seconds", "M-SEARCH"); got != "request_duration_m_search_seconds" {
+		t.Errorf("expected invalid method characters to be replaced, got %s", got)
+	}
+}
@@ -5,7 +5,6 @@ import (
 
 	echoPrometheus "github.com/globocom/echo-prometheus"
 	"github.com/labstack/echo/v4"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -27,7 +26,7 @@ func main() {
 	}
 
 	e.Use(echoPrometheus.MetricsMiddlewareWithConfig(configMetrics))
-	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/metrics", echoPrometheus.MetricsHandlerWithConfig(configMetrics))
 
 	e.GET("/", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Hello, World!")
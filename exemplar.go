@@ -0,0 +1,24 @@
+package echoprometheus
+
+import (
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const requestIDExemplarLabel = "request_id"
+
+// RequestIDExemplar returns the request_id exemplar label of the request, read from the X-Request-ID
+// response header set by the echo RequestID middleware, or nil when there isn't one.
+// Use it as Config.ExemplarFunc, with the RequestID middleware mounted before this one.
+// The RequestID middleware keeps the ID sent by the client, so IDs that are not valid UTF-8
+// or do not fit in an exemplar are ignored.
+func RequestIDExemplar(c echo.Context) prometheus.Labels {
+	id := c.Response().Header().Get(echo.HeaderXRequestID)
+	if id == "" || !utf8.ValidString(id) ||
+		utf8.RuneCountInString(id) > prometheus.ExemplarMaxRunes-len(requestIDExemplarLabel) {
+		return nil
+	}
+	return prometheus.Labels{requestIDExemplarLabel: id}
+}
@@ -0,0 +1,91 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeOpenMetrics returns the metrics of registry in the OpenMetrics format
+func scrapeOpenMetrics(t *testing.T, registry *prometheus.Registry) string {
+	t.Helper()
+	config := Config{Registerer: registry}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	rec := httptest.NewRecorder()
+	e := echo.New()
+	if err := MetricsHandlerWithConfig(config)(e.NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Body.String()
+}
+
+func newRequestIDServer(config Config) *echo.Echo {
+	config.ExemplarFunc = RequestIDExemplar
+	e := echo.New()
+	e.Use(middleware.RequestID())
+	e.Use(MetricsMiddlewareWithConfig(config))
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	return e
+}
+
+func TestRequestIDExemplar(t *testing.T) {
+	config, registry := newTestConfig()
+	e := newRequestIDServer(config)
+
+	rec := serve(e, http.MethodGet, "/foo")
+	id := rec.Header().Get(echo.HeaderXRequestID)
+	if id == "" {
+		t.Fatal("expected the RequestID middleware to set a request ID")
+	}
+
+	if body := scrapeOpenMetrics(t, registry); !strings.Contains(body, `# {request_id="`+id+`"}`) {
+		t.Errorf("expected the request_id exemplar %q in the scrape, got:\n%s", id, body)
+	}
+}
+
+func TestRequestIDExemplarIgnoresOversizedID(t *testing.T) {
+	config, registry := newTestConfig()
+	e := newRequestIDServer(config)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set(echo.HeaderXRequestID, strings.Repeat("a", 200))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	body := scrapeOpenMetrics(t, registry)
+	if strings.Contains(body, "request_id=") {
+		t.Errorf("expected no request_id exemplar for an oversized ID, got:\n%s", body)
+	}
+	if !strings.Contains(body, `echo_http_request_duration_seconds_count{handler="/foo",method="GET"} 1`) {
+		t.Errorf("expected the request to be observed, got:\n%s", body)
+	}
+}
+
+func TestRequestIDExemplarLimits(t *testing.T) {
+	maxID := strings.Repeat("a", prometheus.ExemplarMaxRunes-len("request_id"))
+	ids := map[string]bool{
+		"":          false,
+		"abc":       true,
+		maxID:       true,
+		maxID + "a": false,
+		"\xffabc":   false,
+	}
+	for id, valid := range ids {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		if labels := RequestIDExemplar(c); (labels != nil) != valid {
+			t.Errorf("expected exemplar for %q to be %v, got %v", id, valid, labels)
+		}
+	}
+}
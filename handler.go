@@ -0,0 +1,47 @@
+package echoprometheus
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsHandler returns an echo handler exposing the metrics of the default config.
+func MetricsHandler() echo.HandlerFunc {
+	return MetricsHandlerWithConfig(DefaultConfig)
+}
+
+// MetricsHandlerWithConfig returns an echo handler exposing the metrics gathered from the config registry,
+// with the config HandlerOpts.
+func MetricsHandlerWithConfig(config Config) echo.HandlerFunc {
+	opts := promhttp.HandlerOpts{EnableOpenMetrics: true}
+	if config.HandlerOpts != nil {
+		opts = *config.HandlerOpts
+	}
+	return echo.WrapHandler(promhttp.HandlerFor(gathererFor(config), opts))
+}
+
+// RegisterDefaultCollectors registers the Go runtime and process collectors, as found in the default
+// registry, so a custom registry exposes go_* and process_* metrics too. Already registered ones are kept.
+func RegisterDefaultCollectors(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		if _, err := registerCollector(registerer, collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gathererFor(config Config) prometheus.Gatherer {
+	if config.Gatherer != nil {
+		return config.Gatherer
+	}
+	if gatherer, ok := config.Registerer.(prometheus.Gatherer); ok {
+		return gatherer
+	}
+	return prometheus.DefaultGatherer
+}
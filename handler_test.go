@@ -0,0 +1,93 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsHandlerWithConfig(t *testing.T) {
+	config, _ := newTestConfig()
+	e, _ := newTestServer(config)
+	e.GET("/metrics", MetricsHandlerWithConfig(config))
+
+	serve(e, http.MethodGet, "/foo")
+	rec := serve(e, http.MethodGet, "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `echo_http_requests_total{handler="/foo",method="GET",status="2xx"} 1`) {
+		t.Errorf("expected the /foo request in the metrics, got:\n%s", body)
+	}
+}
+
+func TestMetricsHandlerUsesGatherer(t *testing.T) {
+	config, _ := newTestConfig()
+	e, _ := newTestServer(config)
+	other := prometheus.NewRegistry()
+	other.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "other_total", Help: "Other counter"}))
+	config.Gatherer = other
+	e.GET("/metrics", MetricsHandlerWithConfig(config))
+
+	serve(e, http.MethodGet, "/foo")
+	body := serve(e, http.MethodGet, "/metrics").Body.String()
+	if !strings.Contains(body, "other_total 0") {
+		t.Errorf("expected the gatherer metrics, got:\n%s", body)
+	}
+	if strings.Contains(body, "echo_http_requests_total") {
+		t.Errorf("expected the registerer metrics not to be exposed, got:\n%s", body)
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	config, _ := newTestConfig()
+	e, _ := newTestServer(config)
+	e.GET("/metrics", MetricsHandlerWithConfig(config))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if contentType := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(contentType, "application/openmetrics-text") {
+		t.Errorf("expected OpenMetrics by default, got %s", contentType)
+	}
+
+	// the handler options replace the defaults
+	config.HandlerOpts = &promhttp.HandlerOpts{}
+	e.GET("/plain", MetricsHandlerWithConfig(config))
+	req = httptest.NewRequest(http.MethodGet, "/plain", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if contentType := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("expected the text format without EnableOpenMetrics, got %s", contentType)
+	}
+}
+
+func TestRegisterDefaultCollectors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := RegisterDefaultCollectors(registry); err != nil {
+		t.Fatal(err)
+	}
+	// already registered collectors are kept
+	if err := RegisterDefaultCollectors(registry); err != nil {
+		t.Fatalf("expected registering twice to succeed, got %v", err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		found = found || family.GetName() == "go_goroutines"
+	}
+	if !found {
+		t.Error("expected go_goroutines to be gathered")
+	}
+}
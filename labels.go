@@ -0,0 +1,316 @@
+package echoprometheus
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// extraLabels are the optional labels added to the requests counter and the duration metric
+type extraLabels struct {
+	names     []string
+	appenders []func(values []string, c echo.Context, err error) []string
+}
+
+// add declares label names and the func appending their values, in the same order
+func (l *extraLabels) add(appender func(values []string, c echo.Context, err error) []string, names ...string) {
+	l.names = append(l.names, names...)
+	l.appenders = append(l.appenders, appender)
+}
+
+// values returns the label values of a request, once the handler returned
+func (l *extraLabels) values(c echo.Context, err error) []string {
+	if len(l.names) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(l.names))
+	for _, appender := range l.appenders {
+		values = appender(values, c, err)
+	}
+	return values
+}
+
+// newExtraLabels returns the optional labels enabled by config, limitHit is called when
+// a value is collapsed by MaxHandlerCardinality
+func newExtraLabels(config Config, limitHit func()) *extraLabels {
+	labels := &extraLabels{}
+
+	if len(config.AdditionalLabels) > 0 {
+		labels.add(func(values []string, c echo.Context, _ error) []string {
+			var extracted prometheus.Labels
+			if config.LabelExtractorFunc != nil {
+				extracted = config.LabelExtractorFunc(c)
+			}
+			for _, name := range config.AdditionalLabels {
+				values = append(values, extracted[name])
+			}
+			return values
+		}, config.AdditionalLabels...)
+	}
+
+	if len(config.ContextLabelKeys) > 0 {
+		keys := make([]string, 0, len(config.ContextLabelKeys))
+		names := make([]string, 0, len(config.ContextLabelKeys))
+		limiters := make([]*labelLimiter, 0, len(config.ContextLabelKeys))
+		for key := range config.ContextLabelKeys {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			names = append(names, config.ContextLabelKeys[key])
+			limiters = append(limiters, newLabelLimiter(config.MaxHandlerCardinality))
+		}
+
+		labels.add(func(values []string, c echo.Context, _ error) []string {
+			for i, key := range keys {
+				value := contextLabel(c.Get(key))
+				if !limiters[i].allow(value) {
+					value = otherLabel
+					limitHit()
+				}
+				values = append(values, value)
+			}
+			return values
+		}, names...)
+	}
+
+	if config.EnableAPIVersionLabel {
+		limiter := newLabelLimiter(config.MaxHandlerCardinality)
+		labels.add(func(values []string, c echo.Context, _ error) []string {
+			value := apiVersionLabel(config.APIVersionRegexp, c.Request().Header.Get(config.APIVersionHeader))
+			if !limiter.allow(value) {
+				value = otherLabel
+				limitHit()
+			}
+			return append(values, value)
+		}, "api_version")
+	}
+
+	if config.EnableSchemeLabel {
+		labels.add(func(values []string, c echo.Context, _ error) []string {
+			// c.Scheme trusts forwarded headers, keep only the two expected values
+			if c.Scheme() == "https" {
+				return append(values, "https")
+			}
+			return append(values, "http")
+		}, "scheme")
+	}
+
+	if config.EnableProtoLabel {
+		labels.add(func(values []string, c echo.Context, _ error) []string {
+			return append(values, protoLabel(c.Request().Proto))
+		}, "proto")
+	}
+
+	if config.EnableContentTypeLabel {
+		labels.add(func(values []string, c echo.Context, _ error) []string {
+			return append(values, contentTypeLabel(c.Response().Header().Get(echo.HeaderContentType)))
+		}, "content_type")
+	}
+
+	if config.EnableMatchedLabel {
+		labels.add(func(values []string, c echo.Context, _ error) []string {
+			if isNotFoundHandler(c.Handler()) || isMethodNotAllowedHandler(c.Handler()) {
+				return append(values, "false")
+			}
+			return append(values, "true")
+		}, "matched")
+	}
+
+	if config.EnableMethodClassLabel {
+		classify := config.MethodClassFunc
+		if classify == nil {
+			classify = DefaultMethodClassFunc
+		}
+		labels.add(func(values []string, c echo.Context, _ error) []string {
+			return append(values, classify(c.Request().Method))
+		}, "method_class")
+	}
+
+	return labels
+}
+
+// DefaultMethodClassFunc classifies GET, HEAD and OPTIONS as read, POST, PUT, PATCH and DELETE as write,
+// and any other method as other
+func DefaultMethodClassFunc(method string) string {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return "read"
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return "write"
+	}
+	return otherLabel
+}
+
+// contextLabel returns the label value of a context value, unknown when missing or empty,
+// with invalid UTF-8 replaced
+func contextLabel(value interface{}) string {
+	var label string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		label = v
+	default:
+		label = fmt.Sprint(v)
+	}
+	if label == "" {
+		return unknownLabel
+	}
+	// values set from the request, like a header, may not be valid UTF-8
+	return strings.ToValidUTF8(label, "\uFFFD")
+}
+
+// apiVersionLabel returns the first submatch of re in header, or the whole match without submatches,
+// none when it does not match
+func apiVersionLabel(re *regexp.Regexp, header string) string {
+	match := re.FindStringSubmatch(header)
+	switch {
+	case len(match) > 1 && match[1] != "":
+		return match[1]
+	case len(match) == 1:
+		return match[0]
+	}
+	return noneLabel
+}
+
+// compressedLabel returns whether the response is compressed according to its Content-Encoding
+func compressedLabel(c echo.Context) string {
+	encoding := c.Response().Header().Get(echo.HeaderContentEncoding)
+	return strconv.FormatBool(encoding != "" && !strings.EqualFold(encoding, "identity"))
+}
+
+// contentTypeLabel keeps only the media type of a content type, without its parameters
+func contentTypeLabel(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return unknownLabel
+	}
+	return contentType
+}
+
+// protoLabel bounds the proto label values to the known HTTP versions
+func protoLabel(proto string) string {
+	switch proto {
+	case "HTTP/1.0", "HTTP/1.1", "HTTP/2.0":
+		return proto
+	}
+	return unknownLabel
+}
+
+// RegexpReplacement replaces the matches of Re with Repl, which can refer to submatches like $1
+type RegexpReplacement struct {
+	Re   *regexp.Regexp
+	Repl string
+}
+
+// RegexpHandlerLabelMappingFunc returns a handler label func replacing the matches of each regexp
+// in the request URL path, like UUIDs or numeric IDs, to avoid high cardinality.
+// Replacements are applied in order, so list the most specific patterns first.
+func RegexpHandlerLabelMappingFunc(replacements []RegexpReplacement) func(c echo.Context) string {
+	replacements = append([]RegexpReplacement(nil), replacements...)
+
+	return func(c echo.Context) string {
+		path := c.Request().URL.Path
+		for _, r := range replacements {
+			path = r.Re.ReplaceAllString(path, r.Repl)
+		}
+		// the decoded path of /%ff is not valid UTF-8
+		return strings.ToValidUTF8(path, "\uFFFD")
+	}
+}
+
+// RouteNameHandlerLabelMappingFunc returns a handler label func using the name of the matched route,
+// falling back to the path when the route has no name. Echo names routes after their handler
+// function unless the name is changed on the *echo.Route returned when adding it, so the names of
+// closures and method values, such as main.main.func1, are not used either.
+// Names are looked up once per method and path, so routes must be named before they are served.
+func RouteNameHandlerLabelMappingFunc() func(c echo.Context) string {
+	var names sync.Map
+
+	return func(c echo.Context) string {
+		// unmatched requests have the raw request path, don't cache them, and method not allowed
+		// requests match no route of their method
+		if isNotFoundHandler(c.Handler()) || isMethodNotAllowedHandler(c.Handler()) {
+			return c.Path()
+		}
+
+		key := c.Request().Method + " " + c.Path()
+		if name, ok := names.Load(key); ok {
+			return name.(string)
+		}
+
+		name := c.Path()
+		for _, route := range c.Echo().Routes() {
+			if route.Method == c.Request().Method && route.Path == c.Path() {
+				if route.Name != "" && !goFuncNameRegexp.MatchString(route.Name) {
+					name = route.Name
+				}
+				break
+			}
+		}
+		// misses are cached too, the keys are bounded by the routes and their methods
+		names.Store(key, name)
+		return name
+	}
+}
+
+// goFuncNameRegexp matches the names echo gives to routes served by closures and method values,
+// like main.main.func2.1 or github.com/org/app/handlers.(*Users).Get-fm. Named functions like
+// main.listUsers can't be told from route names like users.list, so they are kept.
+var goFuncNameRegexp = regexp.MustCompile(`(?:\.func\d+(?:\.\d+)*|-fm)$`)
+
+// StripQuery wraps a handler label func to remove the query string and fragment from its label,
+// useful for labels based on the request URI.
+func StripQuery(next func(c echo.Context) string) func(c echo.Context) string {
+	return func(c echo.Context) string {
+		label := next(c)
+		if i := strings.IndexAny(label, "?#"); i >= 0 {
+			return label[:i]
+		}
+		return label
+	}
+}
+
+// TrimTrailingSlash wraps a handler label func to remove a single trailing slash from its label,
+// so /foo and /foo/ are the same series. The root / is left unchanged.
+func TrimTrailingSlash(next func(c echo.Context) string) func(c echo.Context) string {
+	return func(c echo.Context) string {
+		label := next(c)
+		if len(label) > 1 && strings.HasSuffix(label, "/") {
+			return label[:len(label)-1]
+		}
+		return label
+	}
+}
+
+// evictedLabelKey is the context key of the label evicted by LimitedLabels for the request
+const evictedLabelKey = "echoprometheus.evicted_label"
+
+// LimitedLabels wraps a handler label func to return only the max most recently seen labels, collapsing
+// the others to other. A label is kept the second time it is seen, evicting the least recently seen one,
+// so a scan of paths seen once never pushes out the labels in use. Used as HandlerLabelMappingFunc,
+// the series of evicted labels are deleted in the background, bounding the exposed handler labels
+// to max and other. A label seen again while its series are being deleted may lose a few requests.
+func LimitedLabels(next func(c echo.Context) string, max int) func(c echo.Context) string {
+	if max <= 0 {
+		return next
+	}
+	lru := newLabelLRU(max)
+	return func(c echo.Context) string {
+		label, evicted := lru.get(next(c))
+		if evicted != "" {
+			c.Set(evictedLabelKey, evicted)
+		}
+		return label
+	}
+}
@@ -0,0 +1,702 @@
+package echoprometheus
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// contextForRequest returns a context for a GET request of target
+func contextForRequest(target string) echo.Context {
+	return echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), httptest.NewRecorder())
+}
+
+func TestRegexpHandlerLabelMappingFunc(t *testing.T) {
+	label := RegexpHandlerLabelMappingFunc([]RegexpReplacement{
+		{regexp.MustCompile(`/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`), "/:uuid"},
+		{regexp.MustCompile(`/[0-9]+(/|$)`), "/:id$1"},
+	})
+	for target, expected := range map[string]string{
+		"/users":          "/users",
+		"/users/42":       "/users/:id",
+		"/users/42/":      "/users/:id/",
+		"/users/42/posts": "/users/:id/posts",
+		"/users/42?q=1":   "/users/:id",
+		"/orders/123e4567-e89b-12d3-a456-426614174000":       "/orders/:uuid",
+		"/orders/123e4567-e89b-12d3-a456-426614174000/items": "/orders/:uuid/items",
+		"/files/%ff": "/files/\uFFFD",
+	} {
+		if got := label(contextForRequest(target)); got != expected {
+			t.Errorf("expected %s to be labeled %s, got %s", target, expected, got)
+		}
+	}
+}
+
+func TestRegexpHandlerLabelMappingFuncOrder(t *testing.T) {
+	// the numeric pattern would replace the leading digits of the UUID if it ran first
+	label := RegexpHandlerLabelMappingFunc([]RegexpReplacement{
+		{regexp.MustCompile(`/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`), "/:uuid"},
+		{regexp.MustCompile(`/[0-9]+`), "/:id"},
+	})
+	for target, expected := range map[string]string{
+		"/orders/12345678-1234-1234-1234-123456789abc":          "/orders/:uuid",
+		"/orders/42/items/12345678-1234-1234-1234-123456789abc": "/orders/:id/items/:uuid",
+	} {
+		if got := label(contextForRequest(target)); got != expected {
+			t.Errorf("expected %s to be labeled %s, got %s", target, expected, got)
+		}
+	}
+}
+
+func TestNotFoundLabel(t *testing.T) {
+	for _, tc := range []struct {
+		label, expected string
+		disable         bool
+	}{
+		{"", "/not-found", false},
+		{"<not_found>", "<not_found>", false},
+		{"<not_found>", "/missing/42", true},
+	} {
+		config, registry := newTestConfig()
+		config.NotFoundLabel = tc.label
+		config.DisableNotFoundCollapsing = tc.disable
+		e, _ := newTestServer(config)
+		serve(e, http.MethodGet, "/missing/42")
+
+		if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": tc.expected}); value != 1 {
+			t.Errorf("%+v: expected the 404 to be labeled %s, got %v", tc, tc.expected, value)
+		}
+	}
+}
+
+func TestRouteNameHandlerLabelMappingFunc(t *testing.T) {
+	config, _ := newTestConfig()
+	config.HandlerLabelMappingFunc = RouteNameHandlerLabelMappingFunc()
+	metrics, collectors := MetricsMiddlewareWithCollectors(config)
+
+	e := echo.New()
+	e.Use(metrics)
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	e.GET("/users/:id", ok).Name = "get-user"
+	e.GET("/u/:id", ok)
+	e.GET("/inline/:id", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	for _, target := range []string{"/users/1", "/u/1", "/inline/1", "/users/2"} {
+		serve(e, http.MethodGet, target)
+	}
+	serve(e, http.MethodPost, "/users/1")
+
+	expected := map[string]float64{
+		"get-user":    2,
+		"/u/:id":      1,
+		"/inline/:id": 1,
+	}
+	for label, count := range expected {
+		if got := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", label)); got != count {
+			t.Errorf("expected %v requests labeled %q, got %v", count, label, got)
+		}
+	}
+	if got := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("4xx", "POST", "/method-not-allowed")); got != 1 {
+		t.Errorf("expected the method not allowed request to be collapsed, got %v", got)
+	}
+}
+
+func TestGoFuncNameRegexp(t *testing.T) {
+	names := map[string]bool{
+		"main.main.func1":   true,
+		"main.main.func2.1": true,
+		"github.com/org/app/handlers.(*Users).Get-fm": true,
+		"github.com/org/app/handlers.New.func3":       true,
+		"users.list":                                  false,
+		"get-user":                                    false,
+		"GetUser":                                     false,
+		"/users/:id":                                  false,
+		"get user":                                    false,
+	}
+	for name, expected := range names {
+		if got := goFuncNameRegexp.MatchString(name); got != expected {
+			t.Errorf("expected %q to match as a Go function name: %v, got %v", name, expected, got)
+		}
+	}
+}
+
+func TestMethodNotAllowedLabel(t *testing.T) {
+	if !isMethodNotAllowedHandler(echo.MethodNotAllowedHandler) || isMethodNotAllowedHandler(echo.NotFoundHandler) || isMethodNotAllowedHandler(nil) {
+		t.Error("expected only echo.MethodNotAllowedHandler to be detected")
+	}
+
+	for _, tc := range []struct {
+		label   string
+		disable bool
+		series  map[string]float64
+	}{
+		{"", false, map[string]float64{"/method-not-allowed": 2}},
+		{"<405>", false, map[string]float64{"<405>": 2}},
+		{"<405>", true, map[string]float64{"/foo": 1, "/users/:id": 1}},
+	} {
+		config, registry := newTestConfig()
+		config.MethodNotAllowedLabel = tc.label
+		config.DisableNotFoundCollapsing = tc.disable
+		e, _ := newTestServer(config)
+		e.GET("/users/:id", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})
+		serve(e, http.MethodDelete, "/foo")
+		if rec := serve(e, http.MethodDelete, "/users/42"); rec.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("expected a 405, got %d", rec.Code)
+		}
+
+		for handler, expected := range tc.series {
+			if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": handler}); value != expected {
+				t.Errorf("%q, disabled %v: expected %v 405s labeled %s, got %v", tc.label, tc.disable, expected, handler, value)
+			}
+		}
+		if n := seriesCount(t, registry, "echo_http_requests_total"); n != len(tc.series) {
+			t.Errorf("%q, disabled %v: expected %d series, got %d", tc.label, tc.disable, len(tc.series), n)
+		}
+	}
+}
+
+func TestNotFoundLabelFunc(t *testing.T) {
+	config, registry := newTestConfig()
+	config.MaxHandlerCardinality = 3
+	config.NotFoundLabelFunc = func(c echo.Context) string {
+		if parts := strings.SplitN(c.Request().URL.Path, "/", 4); len(parts) > 2 && parts[1] == "api" {
+			return "/api/" + parts[2] + "/*"
+		}
+		return ""
+	}
+	e, _ := newTestServer(config)
+	for _, target := range []string{"/api/v1/missing", "/api/v1/gone", "/random", "/api/v2/missing", "/api/v3/missing"} {
+		serve(e, http.MethodGet, target)
+	}
+
+	for handler, expected := range map[string]float64{
+		"/api/v1/*":  2,
+		"/not-found": 1,
+		"/api/v2/*":  1,
+		// the cardinality guard applies on top
+		"other": 1,
+	} {
+		if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": handler}); value != expected {
+			t.Errorf("expected %v 404s labeled %s, got %v", expected, handler, value)
+		}
+	}
+}
+
+func TestStripQuery(t *testing.T) {
+	label := StripQuery(func(c echo.Context) string {
+		return c.Request().RequestURI
+	})
+	for target, expected := range map[string]string{
+		"/users":             "/users",
+		"/users?page=2":      "/users",
+		"/users?":            "/users",
+		"/users#top":         "/users",
+		"/users?q=a%3Fb#top": "/users",
+		"/a%3Fb%23c":         "/a%3Fb%23c",
+		"/a%3Fb?q=%3F":       "/a%3Fb",
+	} {
+		if got := label(contextForRequest(target)); got != expected {
+			t.Errorf("expected %s to be labeled %s, got %s", target, expected, got)
+		}
+	}
+}
+
+func TestAdditionalLabels(t *testing.T) {
+	config, registry := newTestConfig()
+	config.AdditionalLabels = []string{"tenant", "region"}
+	config.LabelExtractorFunc = func(c echo.Context) prometheus.Labels {
+		// region is missing
+		return prometheus.Labels{"tenant": c.Request().Header.Get("X-Tenant")}
+	}
+	e, collectors := newTestServer(config)
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("X-Tenant", "acme")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", "acme", "")); count != 1 {
+		t.Errorf("expected 1 request labeled with the tenant, got %v", count)
+	}
+	if count := testutil.CollectAndCount(collectors.RequestDuration); count != 1 {
+		t.Errorf("expected 1 duration series, got %d", count)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "echo_http_request_duration_seconds" {
+			continue
+		}
+		labels := make(map[string]string)
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if tenant, ok := labels["tenant"]; !ok || tenant != "acme" {
+			t.Errorf("expected the duration to be labeled with the tenant, got %v", labels)
+		}
+		if region, ok := labels["region"]; !ok || region != "" {
+			t.Errorf("expected an empty region label, got %v", labels)
+		}
+	}
+
+	config.AdditionalLabels = []string{"not-valid"}
+	if err := config.Validate(); err == nil {
+		t.Error("expected an invalid additional label name to be rejected")
+	}
+}
+
+func TestSchemeLabel(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableSchemeLabel = true
+	e, collectors := newTestServer(config)
+	for _, proto := range []string{"", "https", "ftp"} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		if proto != "" {
+			req.Header.Set(echo.HeaderXForwardedProto, proto)
+		}
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", "https")); count != 1 {
+		t.Errorf("expected 1 https request, got %v", count)
+	}
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", "http")); count != 2 {
+		t.Errorf("expected unexpected schemes to be labeled http, got %v http requests", count)
+	}
+}
+
+func TestProtoLabel(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableProtoLabel = true
+	e, collectors := newTestServer(config)
+	for _, proto := range []string{"HTTP/1.0", "HTTP/1.1", "HTTP/2.0", "HTTP/3.0", "SPDY/3", "weird"} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		req.Proto = proto
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for label, expected := range map[string]float64{"HTTP/1.0": 1, "HTTP/1.1": 1, "HTTP/2.0": 1, "unknown": 3} {
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", label)); count != expected {
+			t.Errorf("expected %v %s requests, got %v", expected, label, count)
+		}
+	}
+	if count := testutil.CollectAndCount(collectors.RequestsTotal); count != 4 {
+		t.Errorf("expected 4 requests series, got %d", count)
+	}
+}
+
+func TestContentTypeLabel(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableContentTypeLabel = true
+	e, collectors := newTestServer(config)
+	e.GET("/json", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]string{"ok": "true"})
+	})
+	e.GET("/html", func(c echo.Context) error {
+		return c.HTML(http.StatusOK, "<p>ok</p>")
+	})
+	serve(e, http.MethodGet, "/json")
+	serve(e, http.MethodGet, "/html")
+	serve(e, http.MethodGet, "/foo")
+
+	for handler, contentType := range map[string]string{
+		"/json": "application/json",
+		"/html": "text/html",
+		// no content
+		"/foo": "unknown",
+	} {
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", handler, contentType)); count != 1 {
+			t.Errorf("expected %s to be labeled %s, got %v requests", handler, contentType, count)
+		}
+	}
+}
+
+func TestContentTypeLabelNormalized(t *testing.T) {
+	for contentType, expected := range map[string]string{
+		"application/json; charset=UTF-8": "application/json",
+		"Text/HTML ;charset=utf-8":        "text/html",
+		"application/octet-stream":        "application/octet-stream",
+		"":                                "unknown",
+		"  ":                              "unknown",
+	} {
+		if label := contentTypeLabel(contentType); label != expected {
+			t.Errorf("expected %q to be labeled %q, got %q", contentType, expected, label)
+		}
+	}
+}
+
+func TestTrimTrailingSlash(t *testing.T) {
+	label := TrimTrailingSlash(func(c echo.Context) string {
+		return c.Request().URL.Path
+	})
+	for target, expected := range map[string]string{
+		"/":         "/",
+		"/foo":      "/foo",
+		"/foo/":     "/foo",
+		"/foo/bar/": "/foo/bar",
+		// a single slash is removed
+		"/foo//": "/foo/",
+	} {
+		if got := label(contextForRequest(target)); got != expected {
+			t.Errorf("expected %s to be labeled %s, got %s", target, expected, got)
+		}
+	}
+}
+
+func TestOutcomeFunc(t *testing.T) {
+	config, _ := newTestConfig()
+	config.OutcomeFunc = func(c echo.Context, err error) string {
+		if err != nil || c.Response().Header().Get("X-Error") != "" {
+			return "failure"
+		}
+		return "success"
+	}
+	e, collectors := newTestServer(config)
+	e.GET("/error-body", func(c echo.Context) error {
+		c.Response().Header().Set("X-Error", "quota exceeded")
+		return c.JSON(http.StatusOK, map[string]string{"error": "quota exceeded"})
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return errors.New("failed")
+	})
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/error-body")
+	serve(e, http.MethodGet, "/fail")
+
+	for _, tc := range []struct{ status, handler, outcome string }{
+		{"2xx", "/foo", "success"},
+		// a 200 classified as a failure
+		{"2xx", "/error-body", "failure"},
+		{"5xx", "/fail", "failure"},
+	} {
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues(tc.status, "GET", tc.handler, tc.outcome)); count != 1 {
+			t.Errorf("expected %s to be a %s, got %v", tc.handler, tc.outcome, count)
+		}
+	}
+}
+
+func TestUnknownHandlerLabel(t *testing.T) {
+	config, registry := newTestConfig()
+	metrics, _ := MetricsMiddlewareWithCollectors(config)
+	e := echo.New()
+	// a context which went through no router has no path
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/unrouted", nil), httptest.NewRecorder())
+	handler := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	c.SetHandler(handler)
+	if err := metrics(handler)(c); err != nil {
+		t.Fatal(err)
+	}
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "<unknown>"}); value != 1 {
+		t.Errorf("expected the unrouted request to be labeled <unknown>, got %v", value)
+	}
+
+	// method not allowed requests have a label of their own
+	e, _ = newTestServer(config)
+	serve(e, http.MethodPost, "/foo")
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/method-not-allowed"}); value != 1 {
+		t.Errorf("expected the 405 to be labeled /method-not-allowed, got %v", value)
+	}
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": ""}); value != 0 {
+		t.Errorf("expected no empty handler label, got %v", value)
+	}
+
+	config, registry = newTestConfig()
+	config.UnknownHandlerLabel = "unmatched"
+	config.HandlerLabelMappingFunc = func(echo.Context) string { return "" }
+	e, _ = newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "unmatched"}); value != 1 {
+		t.Errorf("expected an empty mapped label to be replaced, got %v", value)
+	}
+}
+
+func TestContextLabelKeys(t *testing.T) {
+	config, _ := newTestConfig()
+	config.ContextLabelKeys = map[string]string{"tenantID": "tenant"}
+	config.MaxHandlerCardinality = 3
+	e, collectors := newTestServer(config)
+	// resolves the tenant after the metrics middleware, as an authentication middleware would
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if tenant, ok := c.Request().Header["X-Tenant"]; ok {
+				c.Set("tenantID", tenant[0])
+			}
+			return next(c)
+		}
+	})
+
+	for _, tenant := range []string{"acme", "acme", "", "none", "globex", "initech", "umbrella"} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		if tenant != "none" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for tenant, expected := range map[string]float64{
+		"acme": 2,
+		// missing and empty tenants
+		"unknown": 2,
+		"globex":  1,
+		// past the cardinality limit
+		"other": 2,
+	} {
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", tenant)); count != expected {
+			t.Errorf("expected %v requests of tenant %s, got %v", expected, tenant, count)
+		}
+	}
+	if hits := testutil.ToFloat64(collectors.CardinalityLimitHits); hits != 2 {
+		t.Errorf("expected 2 cardinality limit hits, got %v", hits)
+	}
+}
+
+func TestContextLabel(t *testing.T) {
+	for _, tc := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{nil, "unknown"},
+		{"", "unknown"},
+		{"acme", "acme"},
+		{42, "42"},
+		{"acme\xff", "acme\uFFFD"},
+	} {
+		if label := contextLabel(tc.value); label != tc.expected {
+			t.Errorf("expected %v to be labeled %q, got %q", tc.value, tc.expected, label)
+		}
+	}
+}
+
+func TestLimitedLabels(t *testing.T) {
+	limited := LimitedLabels(func(c echo.Context) string {
+		return c.Request().URL.Path
+	}, 3)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		limited(contextForRequest(path))
+	}
+
+	// paths seen once are collapsed and never evict the labels in use
+	for i := 0; i < 50; i++ {
+		if label := limited(contextForRequest("/scan/" + strconv.Itoa(i))); label != otherLabel {
+			t.Fatalf("expected a path seen once to be collapsed to other, got %s", label)
+		}
+	}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		if label := limited(contextForRequest(path)); label != path {
+			t.Errorf("expected %s to be kept, got %s", path, label)
+		}
+	}
+
+	// seen again, a path is kept and the least recently seen one is evicted
+	limited(contextForRequest("/d"))
+	c := contextForRequest("/d")
+	if label := limited(c); label != "/d" {
+		t.Errorf("expected /d to be kept the second time, got %s", label)
+	}
+	if evicted := c.Get(evictedLabelKey); evicted != "/a" {
+		t.Errorf("expected /a to be flagged as evicted, got %v", evicted)
+	}
+}
+
+func TestLimitedLabelsDeletesEvictedSeries(t *testing.T) {
+	config, registry := newTestConfig()
+	config.HandlerLabelMappingFunc = LimitedLabels(func(c echo.Context) string {
+		return c.Request().URL.Path
+	}, 3)
+	e := echo.New()
+	e.Use(MetricsMiddlewareWithConfig(config))
+	e.GET("/*", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	for i := 0; i < 20; i++ {
+		target := "/scan/" + strconv.Itoa(i)
+		serve(e, http.MethodGet, target)
+		serve(e, http.MethodGet, target)
+	}
+
+	// the 3 most recent paths, and other, once the evicted series are deleted in the background
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		handlers := handlerLabelCount(t, registry)
+		if handlers <= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at most 4 handler labels per metric, got %d", handlers)
+		}
+	}
+	if count := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/scan/19"}); count != 1 {
+		t.Errorf("expected the last path to be kept the second time, got %v requests", count)
+	}
+}
+
+// handlerLabelCount returns the highest number of handler label values of a metric
+func handlerLabelCount(t *testing.T, gatherer prometheus.Gatherer) int {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for _, family := range families {
+		handlers := make(map[string]struct{})
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "handler" {
+					handlers[label.GetValue()] = struct{}{}
+				}
+			}
+		}
+		if len(handlers) > count {
+			count = len(handlers)
+		}
+	}
+	return count
+}
+
+func TestAPIVersionLabel(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableAPIVersionLabel = true
+	e, collectors := newTestServer(config)
+	for _, accept := range []string{
+		"application/vnd.myapp.v1+json",
+		"application/vnd.myapp.v2+json",
+		"application/vnd.myapp.v2+json",
+		"application/json",
+		"",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		if accept != "" {
+			req.Header.Set(echo.HeaderAccept, accept)
+		}
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for version, expected := range map[string]float64{"v1": 1, "v2": 2, "none": 2} {
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", version)); count != expected {
+			t.Errorf("expected %v requests labeled %s, got %v", expected, version, count)
+		}
+	}
+}
+
+func TestAPIVersionLabelCustomHeader(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableAPIVersionLabel = true
+	config.APIVersionHeader = "X-API-Version"
+	config.APIVersionRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	e, collectors := newTestServer(config)
+	for _, version := range []string{"2024-01-01", "latest"} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		req.Header.Set("X-API-Version", version)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// the whole match is the version without submatches
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", "2024-01-01")); count != 1 {
+		t.Errorf("expected 1 request labeled with the whole match, got %v", count)
+	}
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", "none")); count != 1 {
+		t.Errorf("expected the unparseable version to be labeled none, got %v", count)
+	}
+}
+
+func TestNilHandler(t *testing.T) {
+	if isNotFoundHandler(nil) {
+		t.Error("expected a nil handler not to be the not found handler")
+	}
+
+	config, registry := newTestConfig()
+	metrics, _ := MetricsMiddlewareWithCollectors(config)
+	// a context whose handler is not set yet, as when the middleware runs before routing
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/unrouted", nil), httptest.NewRecorder())
+	c.SetHandler(nil)
+	if err := metrics(func(c echo.Context) error { return c.NoContent(http.StatusOK) })(c); err != nil {
+		t.Fatal(err)
+	}
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "<unknown>"}); value != 1 {
+		t.Errorf("expected the request to be labeled <unknown>, got %v", value)
+	}
+}
+
+func TestMatchedLabel(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableMatchedLabel = true
+	e, collectors := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/missing")
+	serve(e, http.MethodPost, "/foo")
+
+	for _, tc := range []struct{ status, method, handler, matched string }{
+		{"2xx", "GET", "/foo", "true"},
+		{"4xx", "GET", "/not-found", "false"},
+		{"4xx", "POST", "/method-not-allowed", "false"},
+	} {
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues(tc.status, tc.method, tc.handler, tc.matched)); count != 1 {
+			t.Errorf("expected 1 %s %s request labeled matched %s, got %v", tc.method, tc.handler, tc.matched, count)
+		}
+	}
+	if count := testutil.CollectAndCount(collectors.RequestsTotal); count != 3 {
+		t.Errorf("expected 3 series, got %d", count)
+	}
+}
+
+func TestDefaultMethodClassFunc(t *testing.T) {
+	for method, class := range map[string]string{
+		http.MethodGet:     "read",
+		http.MethodHead:    "read",
+		http.MethodOptions: "read",
+		http.MethodPost:    "write",
+		http.MethodPut:     "write",
+		http.MethodPatch:   "write",
+		http.MethodDelete:  "write",
+		http.MethodConnect: "other",
+		http.MethodTrace:   "other",
+		"get":              "read",
+		"PROPFIND":         "other",
+	} {
+		if label := DefaultMethodClassFunc(method); label != class {
+			t.Errorf("expected %s to be classified %s, got %s", method, class, label)
+		}
+	}
+}
+
+func TestMethodClassLabel(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableMethodClassLabel = true
+	e, collectors := newTestServer(config)
+	e.POST("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodPost, "/foo")
+
+	for method, class := range map[string]string{"GET": "read", "POST": "write"} {
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", method, "/foo", class)); count != 1 {
+			t.Errorf("expected 1 %s request labeled %s, got %v", method, class, count)
+		}
+	}
+
+	config, _ = newTestConfig()
+	config.EnableMethodClassLabel = true
+	config.MethodClassFunc = func(string) string { return "any" }
+	e, collectors = newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo", "any")); count != 1 {
+		t.Errorf("expected the request to be labeled by MethodClassFunc, got %v", count)
+	}
+}
@@ -2,24 +2,414 @@
 package echoprometheus
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net/http"
 	"reflect"
-	"strconv"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Config responsible to configure middleware
+// Config responsible to configure middleware.
+// The middleware keeps a copy of it, changing a config after creating its middleware has no effect.
 type Config struct {
 	HandlerLabelMappingFunc func(c echo.Context) string
-	Skipper                 middleware.Skipper
 	Namespace               string
 	Subsystem               string
 	Buckets                 []float64
 	NormalizeHTTPStatus     bool
+
+	// Skipper is called before the next handler, skipped requests are not recorded in any metric.
+	// The exceptions are opt-in: RecordTimestampAlways still sets the last request timestamp,
+	// AlwaysRunAfterFunc still times the request for AfterFunc, and RecordErrorsWhenSkipped
+	// still counts the failed requests in the requests and errors counters.
+	Skipper middleware.Skipper
+
+	// Disabled makes the middleware call the next handler without recording anything,
+	// and register no collector, so it can be mounted unconditionally in every environment
+	Disabled bool
+
+	// NotFoundLabel is the handler label of requests routed to echo.NotFoundHandler, /not-found when empty,
+	// and MethodNotAllowedLabel the one of echo.MethodNotAllowedHandler, /method-not-allowed when empty.
+	// DisableNotFoundCollapsing keeps the mapped handler label for both instead.
+	NotFoundLabel             string
+	MethodNotAllowedLabel     string
+	DisableNotFoundCollapsing bool
+
+	// NotFoundLabelFunc returns the handler label of requests routed to echo.NotFoundHandler instead
+	// of NotFoundLabel, used when it returns an empty label, for instance to keep a known path prefix.
+	// MaxHandlerCardinality still applies.
+	NotFoundLabelFunc func(c echo.Context) string
+
+	// UnknownHandlerLabel replaces an empty handler label, as returned for requests matching no route
+	// outside of echo.NotFoundHandler, <unknown> when empty
+	UnknownHandlerLabel string
+
+	// MaxHandlerCardinality caps the number of distinct handler label values, and of each ContextLabelKeys
+	// label values, new ones past the limit are collapsed to other and counted in cardinality_limit_hit_total.
+	// 0 means unlimited.
+	MaxHandlerCardinality int
+
+	// AllowedMethods are the method label values, other methods are recorded as other.
+	// The standard HTTP methods are allowed when empty.
+	// NormalizeMethod uppercases the method first, so get and GET are the same series.
+	AllowedMethods  []string
+	NormalizeMethod bool
+
+	// PreserveStatusCodes are kept exact when the status label is the status class,
+	// like 429 and 503 among the other 4xx and 5xx
+	PreserveStatusCodes []int
+
+	// StatusLabelFunc maps the response status to the status label, takes precedence over NormalizeHTTPStatus
+	StatusLabelFunc func(status int) string
+
+	// HijackedStatusLabel is the status label of hijacked connections, like websockets, hijacked when empty
+	HijackedStatusLabel string
+
+	// SeparateWebsocketMetrics counts websocket upgrades with status 101 and records their lifetime
+	// in the websocket_connection_duration_seconds histogram instead of the duration metric
+	SeparateWebsocketMetrics bool
+
+	// UseHTTPErrorCode uses the code of an echo.HTTPError returned by the handler as the status
+	// when no response was written, for instance by a custom HTTPErrorHandler rendering errors later
+	UseHTTPErrorCode bool
+
+	// StatusLabelName, MethodLabelName and HandlerLabelName rename the status, method and handler labels,
+	// status, method and handler when empty. StatusLabelModeBoth labels are not renamed.
+	StatusLabelName  string
+	MethodLabelName  string
+	HandlerLabelName string
+
+	// StatusLabelMode chooses the status labels of the requests counter
+	StatusLabelMode StatusLabelMode
+
+	// RequestsCounterName and DurationHistogramName override the requests_total and
+	// request_duration_seconds metric names, the latter defaults to the DurationUnit name
+	RequestsCounterName   string
+	DurationHistogramName string
+
+	// RequestsCounterHelp and DurationHistogramHelp override the help of the requests counter and the duration metric
+	RequestsCounterHelp   string
+	DurationHistogramHelp string
+
+	// DisableRequestCounter and DisableDurationHistogram disable the requests_total counter
+	// and the request_duration_seconds histogram, they are not registered at all
+	DisableRequestCounter    bool
+	DisableDurationHistogram bool
+
+	// MethodAsMetricSuffix records the duration of each method in its own metric without method label,
+	// like request_duration_get_seconds, for the AllowedMethods and other. Apdex does not read them.
+	MethodAsMetricSuffix bool
+
+	// DurationUnit is the unit of the request duration metric and its name suffix, seconds by default.
+	// Buckets and BucketsPerHandler must be expressed in the same unit, empty Buckets default to
+	// DefaultBuckets converted to the unit. The other duration histograms stay in seconds,
+	// with Buckets converted to seconds.
+	DurationUnit DurationUnit
+
+	// BucketsPerHandler overrides Buckets for some handler label values. Their series are collected
+	// in the same request_duration_seconds family, with different buckets, so aggregating them
+	// across handlers with histogram_quantile only works on common bucket boundaries.
+	// Empty handler buckets use Buckets.
+	BucketsPerHandler map[string][]float64
+
+	// DurationMetricType chooses between a histogram and a summary for the request duration,
+	// Objectives are the summary quantiles, 0.5, 0.9 and 0.99 when empty
+	DurationMetricType DurationMetricType
+	Objectives         map[float64]float64
+
+	// SummaryMaxAge and SummaryAgeBuckets set the sliding window the summary quantiles are computed on,
+	// and the number of buckets it is rotated with, 10 minutes and 5 when zero
+	SummaryMaxAge     time.Duration
+	SummaryAgeBuckets int
+
+	// NativeHistogram adds native histogram buckets to the duration histogram, classic Buckets
+	// are still emitted unless DisableClassicBuckets is set. Zero native histogram settings
+	// default to a 1.1 bucket factor, 160 buckets and a 1h reset duration.
+	NativeHistogram                 bool
+	NativeHistogramBucketFactor     float64
+	NativeHistogramMaxBucketNumber  uint32
+	NativeHistogramMinResetDuration time.Duration
+	DisableClassicBuckets           bool
+
+	// SLOThreshold enables the requests_slo_violations_total counter, incremented for requests slower than it
+	SLOThreshold time.Duration
+
+	// EnableDeadlineMetric enables the deadline_exceeded_total counter, incremented for requests
+	// whose context deadline was exceeded when the handler returned, as set by a timeout middleware
+	EnableDeadlineMetric bool
+
+	// SampleRate is the fraction of requests observed in the duration metric, between 0 and 1,
+	// every request when nil, as in DefaultConfig and NewConfig, and none when 0. Set it with the SampleRate
+	// func, the middleware keeps a copy of the rate so changing it afterwards has no effect. Sampling lowers the
+	// observation cost under heavy load: the duration distribution stays unbiased but gets noisier
+	// as the rate drops, and its _count and _sum only cover the sampled requests. The requests
+	// counter is never sampled. WithSampleRate sets it with New.
+	SampleRate *float64
+
+	// ExemplarFunc returns the exemplar labels, like a trace ID, attached to the duration observations.
+	// Exemplars are only exposed in the OpenMetrics format.
+	ExemplarFunc func(c echo.Context) prometheus.Labels
+
+	// DisableInFlightGauge disables the requests_in_flight gauge
+	DisableInFlightGauge bool
+
+	// EnableInFlightMax enables the requests_in_flight_max gauge, the highest number of requests
+	// processed concurrently since the start, across all handlers
+	EnableInFlightMax bool
+
+	// EnableSizeMetrics enables the request and response size histograms, using SizeBuckets.
+	// Response sizes are the bytes written by the handler, before any compression by the Gzip middleware.
+	// EnableCompressedLabel adds a compressed label, true or false, to the response size histogram,
+	// following the response Content-Encoding.
+	EnableSizeMetrics     bool
+	SizeBuckets           []float64
+	EnableCompressedLabel bool
+
+	// EnableByteCounters enables the request_bytes_total and response_bytes_total counters,
+	// cheaper than the size histograms when only totals matter. Unknown request sizes are not added.
+	EnableByteCounters bool
+
+	// EnableErrorMetric enables the errors_total counter, labeled by the type of error returned by the handler
+	EnableErrorMetric bool
+
+	// EnableTTFB enables the time_to_first_byte_seconds histogram, using Buckets
+	EnableTTFB bool
+
+	// EnablePhaseMetrics enables the request_phase_duration_seconds histogram, using Buckets, with a handler
+	// phase for everything after this middleware in the chain, so its position decides what is measured,
+	// and the phases marked in the handlers with MeasureFrom and MeasureTo
+	EnablePhaseMetrics bool
+
+	// EnableStartedCounter enables the requests_started_total counter, incremented before the handler runs,
+	// comparing it to requests_total reveals handlers that never return
+	EnableStartedCounter bool
+
+	// EnableClassOnlyCounter enables the requests_by_class_total counter, labeled only with the status class,
+	// a low cardinality rollup of the requests counter
+	EnableClassOnlyCounter bool
+
+	// EnableLastRequestGauge enables the last_request_timestamp_seconds gauge, set on each recorded request,
+	// or on every request including skipped ones when RecordTimestampAlways is set
+	EnableLastRequestGauge bool
+	RecordTimestampAlways  bool
+
+	// EnableLastDurationGauge enables the last_request_duration_seconds gauge, set to the duration
+	// of the last request, for displays that do not compute quantiles
+	EnableLastDurationGauge bool
+
+	// QueueTimeHeader enables the queue_time_seconds histogram, using Buckets, from a header set
+	// by the edge proxy with the time the request entered it, in epoch seconds, milliseconds or
+	// microseconds, optionally prefixed with t=. Requests without a valid header are not observed.
+	QueueTimeHeader string
+
+	// BuildInfo enables the build_info gauge, always 1, under Namespace only and labeled with
+	// the map entries, for instance version and commit. go_version defaults to the running Go version.
+	BuildInfo map[string]string
+
+	// EnableUpGauge enables the app_up gauge under Namespace only, 0 until the application
+	// calls Collectors.SetUp(true) and back to 0 with SetDown, for instance while draining
+	EnableUpGauge bool
+
+	// RecoverPanics counts handler panics in panics_total before panicking again,
+	// so the recover middleware still handles them
+	RecoverPanics bool
+
+	// InstrumentPanics counts handler panics in panics_total and records the request as a 500,
+	// duration included, before panicking again. It works without recover middleware.
+	InstrumentPanics bool
+
+	// BeforeFunc is called with the handler label before the next handler runs, for instance to log it,
+	// it is not called for skipped requests
+	BeforeFunc func(c echo.Context, handler string)
+
+	// AfterFunc is called after the metrics of a request are recorded, it is not called for skipped
+	// requests unless AlwaysRunAfterFunc is set. Panics in AfterFunc are not recovered.
+	AfterFunc          func(c echo.Context, status int, dur time.Duration, err error)
+	AlwaysRunAfterFunc bool
+
+	// RecordErrorsWhenSkipped still counts skipped requests in the requests and errors counters
+	// when the handler returns an error or the status is 5xx
+	RecordErrorsWhenSkipped bool
+
+	// AdditionalLabels are label names added to the requests counter and the duration metric,
+	// their values are returned by LabelExtractorFunc and default to an empty string when missing
+	AdditionalLabels   []string
+	LabelExtractorFunc func(c echo.Context) prometheus.Labels
+
+	// OutcomeFunc adds an outcome label to the requests counter, like success or failure,
+	// for success ratios that do not follow the status
+	OutcomeFunc func(c echo.Context, err error) string
+
+	// ContextLabelKeys maps context keys to label names added to the requests counter and the duration metric,
+	// their values are read with c.Get and default to unknown when missing or empty. Set MaxHandlerCardinality
+	// to bound them when they come from the request, like a tenant.
+	ContextLabelKeys map[string]string
+
+	// EnableAPIVersionLabel adds an api_version label to the requests counter and the duration metric,
+	// the first APIVersionRegexp submatch in the APIVersionHeader request header, or none.
+	// They default to Accept and \b(v\d+)\b, matching v2 in application/vnd.myapp.v2+json.
+	// Set MaxHandlerCardinality to bound the versions sent by clients.
+	EnableAPIVersionLabel bool
+	APIVersionHeader      string
+	APIVersionRegexp      *regexp.Regexp
+
+	// EnableSchemeLabel adds a scheme label, http or https, to the requests counter and the duration metric
+	EnableSchemeLabel bool
+
+	// EnableProtoLabel adds a proto label, HTTP/1.0, HTTP/1.1, HTTP/2.0 or unknown,
+	// to the requests counter and the duration metric
+	EnableProtoLabel bool
+
+	// EnableContentTypeLabel adds a content_type label, the response media type or unknown,
+	// to the requests counter and the duration metric
+	EnableContentTypeLabel bool
+
+	// EnableMatchedLabel adds a matched label, false for requests served by the echo not found
+	// and method not allowed handlers, to the requests counter and the duration metric
+	EnableMatchedLabel bool
+
+	// EnableMethodClassLabel adds a method_class label, as returned by MethodClassFunc for the request
+	// method, to the requests counter and the duration metric. MethodClassFunc defaults to DefaultMethodClassFunc.
+	EnableMethodClassLabel bool
+	MethodClassFunc        func(method string) string
+
+	// CacheSeries keeps the requests counter and duration metric children by label values, avoiding
+	// the vector lookup on every request. The cache holds an entry per series, so it grows with the
+	// labels cardinality and series deleted from the vectors keep being referenced.
+	CacheSeries bool
+
+	// HandlerOpts are the options of the metrics handler returned by MetricsHandlerWithConfig,
+	// EnableOpenMetrics only when nil so exemplars are exposed to scrapers asking for OpenMetrics
+	HandlerOpts *promhttp.HandlerOpts
+
+	// PushGateway enables pushing the metrics to a Pushgateway in the background
+	PushGateway *PushGatewayConfig
+
+	// NowFunc returns the current time used to measure durations, time.Now when nil
+	NowFunc func() time.Time
+
+	// ConstLabels are added to every metric, changing them requires creating the middleware again
+	ConstLabels prometheus.Labels
+
+	// Registerer used to register the collectors, prometheus.DefaultRegisterer when nil
+	Registerer prometheus.Registerer
+
+	// Gatherer used by the metrics handler, falls back to Registerer when it is a Gatherer
+	// and to prometheus.DefaultGatherer otherwise
+	Gatherer prometheus.Gatherer
+
+	// errorsOnly counts only failed requests in the errors counter, see ErrorMetricsMiddleware
+	errorsOnly bool
+
+	// unregistered keeps the collectors in a private registry, see UnregisteredMetricsMiddleware
+	unregistered bool
+}
+
+var (
+	metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	defaultAPIVersionRegexp = regexp.MustCompile(`\b(v\d+)\b`)
+)
+
+// validLabelName reports whether name is a valid label name, names starting with __ are reserved
+func validLabelName(name string) bool {
+	return labelNameRegexp.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+// Validate checks the config values that prometheus would reject or mishandle.
+// Nil functions and empty buckets, nil or not, are valid, they are replaced by the DefaultConfig ones.
+func (c Config) Validate() error {
+	if c.Namespace != "" && !metricNameRegexp.MatchString(c.Namespace) {
+		return fmt.Errorf("invalid namespace %q", c.Namespace)
+	}
+	if c.Subsystem != "" && !metricNameRegexp.MatchString(c.Subsystem) {
+		return fmt.Errorf("invalid subsystem %q", c.Subsystem)
+	}
+	if c.RequestsCounterName != "" && !metricNameRegexp.MatchString(c.RequestsCounterName) {
+		return fmt.Errorf("invalid requests counter name %q", c.RequestsCounterName)
+	}
+	if c.DurationHistogramName != "" && !metricNameRegexp.MatchString(c.DurationHistogramName) {
+		return fmt.Errorf("invalid duration histogram name %q", c.DurationHistogramName)
+	}
+	if err := validateBuckets(c.Buckets); err != nil {
+		return fmt.Errorf("invalid buckets: %w", err)
+	}
+	for handler, buckets := range c.BucketsPerHandler {
+		if err := validateBuckets(buckets); err != nil {
+			return fmt.Errorf("invalid buckets for handler %q: %w", handler, err)
+		}
+	}
+	for _, name := range []string{c.StatusLabelName, c.MethodLabelName, c.HandlerLabelName} {
+		if name != "" && !validLabelName(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	for _, name := range c.AdditionalLabels {
+		if !validLabelName(name) {
+			return fmt.Errorf("invalid additional label %q", name)
+		}
+	}
+	for _, name := range c.ContextLabelKeys {
+		if !validLabelName(name) {
+			return fmt.Errorf("invalid context label %q", name)
+		}
+	}
+	for name := range c.BuildInfo {
+		if !validLabelName(name) {
+			return fmt.Errorf("invalid build info label %q", name)
+		}
+	}
+	if c.SummaryMaxAge < 0 {
+		return fmt.Errorf("invalid summary max age %v", c.SummaryMaxAge)
+	}
+	if c.SummaryAgeBuckets < 0 {
+		return fmt.Errorf("invalid summary age buckets %d", c.SummaryAgeBuckets)
+	}
+	if c.MaxHandlerCardinality < 0 {
+		return fmt.Errorf("invalid max handler cardinality %d", c.MaxHandlerCardinality)
+	}
+	if c.PushGateway != nil && (c.PushGateway.URL == "" || c.PushGateway.Job == "") {
+		return errors.New("invalid push gateway, URL and Job are required")
+	}
+	if c.SLOThreshold < 0 {
+		return fmt.Errorf("invalid SLO threshold %v", c.SLOThreshold)
+	}
+	if c.SampleRate != nil && (*c.SampleRate < 0 || *c.SampleRate > 1) {
+		return fmt.Errorf("invalid sample rate %v, it must be between 0 and 1", *c.SampleRate)
+	}
+	if c.NativeHistogramBucketFactor != 0 && c.NativeHistogramBucketFactor <= 1 {
+		return fmt.Errorf("invalid native histogram bucket factor %v, it must be greater than 1", c.NativeHistogramBucketFactor)
+	}
+	if err := validateBuckets(c.SizeBuckets); err != nil {
+		return fmt.Errorf("invalid size buckets: %w", err)
+	}
+	return nil
+}
+
+func validateBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("%v is not greater than %v, buckets must be strictly increasing", buckets[i], buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// SampleRate returns a new pointer to rate, for Config.SampleRate
+func SampleRate(rate float64) *float64 {
+	return &rate
 }
 
 // DefaultHandlerLabelMappingFunc returns the handler path
@@ -33,60 +423,267 @@ func DefaultSkipper(c echo.Context) bool {
 }
 
 const (
-	httpRequestsCount    = "requests_total"
-	httpRequestsDuration = "request_duration_seconds"
-	notFoundPath         = "/not-found"
+	httpRequestsCount           = "requests_total"
+	httpRequestsDuration        = "request_duration_seconds"
+	httpRequestsDurationMs      = "request_duration_milliseconds"
+	httpRequestsInFlight        = "requests_in_flight"
+	httpRequestsInFlightMax     = "requests_in_flight_max"
+	httpRequestSize             = "request_size_bytes"
+	httpResponseSize            = "response_size_bytes"
+	httpErrorsCount             = "errors_total"
+	httpPanicsCount             = "panics_total"
+	httpTimeToFirstByte         = "time_to_first_byte_seconds"
+	httpRequestsStarted         = "requests_started_total"
+	httpRequestsByClass         = "requests_by_class_total"
+	httpLastRequestTimestamp    = "last_request_timestamp_seconds"
+	httpQueueTime               = "queue_time_seconds"
+	httpPhaseDuration           = "request_phase_duration_seconds"
+	httpSLOViolations           = "requests_slo_violations_total"
+	httpLastRequestDuration     = "last_request_duration_seconds"
+	httpRequestBytes            = "request_bytes_total"
+	httpResponseBytes           = "response_bytes_total"
+	httpDeadlineExceeded        = "deadline_exceeded_total"
+	websocketConnectionDuration = "websocket_connection_duration_seconds"
+	buildInfo                   = "build_info"
+	appUp                       = "app_up"
+	cardinalityLimitHits        = "cardinality_limit_hit_total"
+	notFoundPath                = "/not-found"
+	methodNotAllowedPath        = "/method-not-allowed"
+	unknownHandler              = "<unknown>"
+	hijackedStatus              = "hijacked"
+	otherMethod                 = "other"
+	otherHandler                = "other"
+	otherLabel                  = "other"
+	unknownLabel                = "unknown"
+	noneLabel                   = "none"
+
+	// statusClientClosedRequest is the nginx status of requests canceled by the client
+	statusClientClosedRequest = 499
+
+	defaultRequestsCounterHelp   = "Number of HTTP requests processed"
+	defaultDurationHistogramHelp = "Time spent processing HTTP requests"
 )
 
-// DefaultConfig has the default instrumentation config
+// DefaultConfig has the default instrumentation config, its Buckets are empty so they follow DurationUnit
 var DefaultConfig = Config{
-	Namespace: "echo",
-	Subsystem: "http",
-	Buckets: []float64{
-		0.0005,
-		0.001, // 1ms
-		0.002,
-		0.005,
-		0.01, // 10ms
-		0.02,
-		0.05,
-		0.1, // 100 ms
-		0.2,
-		0.5,
-		1.0, // 1s
-		2.0,
-		5.0,
-		10.0, // 10s
-		15.0,
-		20.0,
-		30.0,
-	},
+	Namespace:               "echo",
+	Subsystem:               "http",
+	SizeBuckets:             defaultSizeBuckets(),
+	NotFoundLabel:           notFoundPath,
+	MethodNotAllowedLabel:   methodNotAllowedPath,
+	UnknownHandlerLabel:     unknownHandler,
+	HijackedStatusLabel:     hijackedStatus,
 	NormalizeHTTPStatus:     true,
 	Skipper:                 DefaultSkipper,
 	HandlerLabelMappingFunc: DefaultHandlerLabelMappingFunc,
 }
 
-// nolint: gomnd
-func normalizeHTTPStatus(status int) string {
-	if status < 200 {
-		return "1xx"
-	} else if status < 300 {
-		return "2xx"
-	} else if status < 400 {
-		return "3xx"
-	} else if status < 500 {
-		return "4xx"
+const (
+	errorTypeHTTP     = "http"
+	errorTypeInternal = "internal"
+	errorTypeNone     = "none"
+)
+
+// errorType classifies the error returned by a handler
+func errorType(err error) string {
+	if err == nil {
+		return errorTypeNone
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return errorTypeHTTP
 	}
-	return "5xx"
+	return errorTypeInternal
 }
 
+var (
+	notFoundHandlerPtr         = reflect.ValueOf(echo.NotFoundHandler).Pointer()
+	methodNotAllowedHandlerPtr = reflect.ValueOf(echo.MethodNotAllowedHandler).Pointer()
+)
+
+// isNotFoundHandler reports whether handler is echo.NotFoundHandler, a nil handler
+// when the middleware runs before routing is not
 func isNotFoundHandler(handler echo.HandlerFunc) bool {
-	return reflect.ValueOf(handler).Pointer() == reflect.ValueOf(echo.NotFoundHandler).Pointer()
+	if handler == nil {
+		return false
+	}
+	return reflect.ValueOf(handler).Pointer() == notFoundHandlerPtr
+}
+
+// isMethodNotAllowedHandler reports whether handler is echo.MethodNotAllowedHandler
+func isMethodNotAllowedHandler(handler echo.HandlerFunc) bool {
+	if handler == nil {
+		return false
+	}
+	return reflect.ValueOf(handler).Pointer() == methodNotAllowedHandlerPtr
+}
+
+// isHijacked reports whether an upgrade request was answered without writing a response,
+// meaning the handler hijacked the connection
+func isHijacked(c echo.Context) bool {
+	return !c.Response().Committed &&
+		strings.Contains(strings.ToLower(c.Request().Header.Get("Connection")), "upgrade")
+}
+
+// isWebsocket reports whether the request is an accepted websocket upgrade, answered with 101
+// or hijacked by the upgrader. A rejected handshake, like a 403, is a regular request.
+func isWebsocket(c echo.Context) bool {
+	return c.Response().Status == http.StatusSwitchingProtocols ||
+		strings.EqualFold(c.Request().Header.Get("Upgrade"), "websocket") && isHijacked(c)
+}
+
+var standardMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+}
+
+// allowedMethods returns a func bounding the method label values to methods
+func allowedMethods(methods []string, normalize bool) func(method string) string {
+	if len(methods) == 0 {
+		methods = standardMethods
+	}
+	allowed := make(map[string]struct{}, len(methods))
+	for _, method := range methods {
+		allowed[method] = struct{}{}
+	}
+	return func(method string) string {
+		if normalize {
+			method = strings.ToUpper(method)
+		}
+		if _, ok := allowed[method]; ok {
+			return method
+		}
+		return otherMethod
+	}
 }
 
-// NewConfig returns a new config with default values
+// registerCollector registers the collector, returning the already registered one when it exists
+func registerCollector(registerer prometheus.Registerer, collector prometheus.Collector) (prometheus.Collector, error) {
+	if err := registerer.Register(collector); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector, nil
+		}
+		return collector, err
+	}
+	return collector, nil
+}
+
+// snapshot returns a copy of config sharing no slice or map with it, so the middleware is not
+// affected by later changes of the caller config
+func (c Config) snapshot() Config {
+	c.Buckets = slices.Clone(c.Buckets)
+	c.SizeBuckets = slices.Clone(c.SizeBuckets)
+	c.AllowedMethods = slices.Clone(c.AllowedMethods)
+	c.PreserveStatusCodes = slices.Clone(c.PreserveStatusCodes)
+	c.AdditionalLabels = slices.Clone(c.AdditionalLabels)
+	c.Objectives = maps.Clone(c.Objectives)
+	c.BuildInfo = maps.Clone(c.BuildInfo)
+	c.ContextLabelKeys = maps.Clone(c.ContextLabelKeys)
+	c.ConstLabels = maps.Clone(c.ConstLabels)
+	if c.BucketsPerHandler != nil {
+		buckets := make(map[string][]float64, len(c.BucketsPerHandler))
+		for handler, b := range c.BucketsPerHandler {
+			buckets[handler] = slices.Clone(b)
+		}
+		c.BucketsPerHandler = buckets
+	}
+	if c.PushGateway != nil {
+		push := *c.PushGateway
+		c.PushGateway = &push
+	}
+	return c
+}
+
+// withDefaults fills the zero values of config that would break the middleware
+func withDefaults(config Config) Config {
+	if config.HandlerLabelMappingFunc == nil {
+		config.HandlerLabelMappingFunc = DefaultHandlerLabelMappingFunc
+	}
+	if config.Skipper == nil {
+		config.Skipper = DefaultSkipper
+	}
+	if config.NowFunc == nil {
+		config.NowFunc = time.Now
+	}
+	if config.HijackedStatusLabel == "" {
+		config.HijackedStatusLabel = hijackedStatus
+	}
+	if config.NotFoundLabel == "" {
+		config.NotFoundLabel = notFoundPath
+	}
+	if config.MethodNotAllowedLabel == "" {
+		config.MethodNotAllowedLabel = methodNotAllowedPath
+	}
+	if config.StatusLabelName == "" {
+		config.StatusLabelName = "status"
+	}
+	if config.MethodLabelName == "" {
+		config.MethodLabelName = "method"
+	}
+	if config.HandlerLabelName == "" {
+		config.HandlerLabelName = "handler"
+	}
+	if config.APIVersionHeader == "" {
+		config.APIVersionHeader = echo.HeaderAccept
+	}
+	if config.APIVersionRegexp == nil {
+		config.APIVersionRegexp = defaultAPIVersionRegexp
+	}
+	if config.UnknownHandlerLabel == "" {
+		config.UnknownHandlerLabel = unknownHandler
+	}
+	if config.RequestsCounterName == "" {
+		config.RequestsCounterName = httpRequestsCount
+	}
+	if config.DurationHistogramName == "" {
+		config.DurationHistogramName = config.DurationUnit.metricName()
+	}
+	if config.RequestsCounterHelp == "" {
+		config.RequestsCounterHelp = defaultRequestsCounterHelp
+	}
+	if config.DurationHistogramHelp == "" {
+		config.DurationHistogramHelp = defaultDurationHistogramHelp
+	}
+	if len(config.Buckets) == 0 {
+		config.Buckets = config.DurationUnit.buckets(DefaultBuckets())
+	}
+	if len(config.Objectives) == 0 {
+		config.Objectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+	}
+	// copied, so the caller can't change the rate of the middleware through the pointer
+	rate := 1.0
+	if config.SampleRate != nil {
+		rate = *config.SampleRate
+	}
+	config.SampleRate = SampleRate(rate)
+	if config.NativeHistogramBucketFactor == 0 {
+		config.NativeHistogramBucketFactor = defaultNativeHistogramBucketFactor
+	}
+	if config.NativeHistogramMaxBucketNumber == 0 {
+		config.NativeHistogramMaxBucketNumber = defaultNativeHistogramMaxBucketNumber
+	}
+	if config.NativeHistogramMinResetDuration == 0 {
+		config.NativeHistogramMinResetDuration = defaultNativeHistogramMinResetDuration
+	}
+	if len(config.SizeBuckets) == 0 {
+		config.SizeBuckets = defaultSizeBuckets()
+	}
+	return config
+}
+
+// NewConfig returns a new config with default values, its buckets can be modified without changing DefaultConfig
 func NewConfig() Config {
-	return DefaultConfig
+	config := DefaultConfig
+	config.SizeBuckets = slices.Clone(DefaultConfig.SizeBuckets)
+	return config
 }
 
 // MetricsMiddleware returns an echo middleware with default config for instrumentation.
@@ -95,56 +692,390 @@ func MetricsMiddleware() echo.MiddlewareFunc {
 }
 
 // MetricsMiddlewareWithConfig returns an echo middleware for instrumentation.
+// It panics when the config is not valid or a collector cannot be registered,
+// like MustMetricsMiddlewareWithConfig.
 func MetricsMiddlewareWithConfig(config Config) echo.MiddlewareFunc {
-	httpRequests := promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: config.Namespace,
-		Subsystem: config.Subsystem,
-		Name:      httpRequestsCount,
-		Help:      "Number of HTTP operations",
-	}, []string{"status", "method", "handler"})
-
-	httpDuration := promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: config.Namespace,
-		Subsystem: config.Subsystem,
-		Name:      httpRequestsDuration,
-		Help:      "Spend time by processing a route",
-		Buckets:   config.Buckets,
-	}, []string{"method", "handler"})
+	return MustMetricsMiddlewareWithConfig(config)
+}
+
+// MustMetricsMiddlewareWithConfig returns an echo middleware for instrumentation.
+// It panics when the config is not valid or a collector cannot be registered.
+func MustMetricsMiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	m, err := MetricsMiddlewareWithConfigE(config)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// MetricsMiddlewareWithConfigE returns an echo middleware for instrumentation, or an error when the config
+// is not valid or a collector cannot be registered. Prefer it when the config is built at runtime,
+// for instance from flags, and the Must variant for configs fixed in the code.
+func MetricsMiddlewareWithConfigE(config Config) (echo.MiddlewareFunc, error) {
+	m, _, err := newMetricsMiddleware(config)
+	return m, err
+}
+
+// MetricsMiddlewareWithCollectors returns an echo middleware for instrumentation and the collectors it records into.
+// It panics when the config is not valid or a collector cannot be registered.
+func MetricsMiddlewareWithCollectors(config Config) (echo.MiddlewareFunc, *Collectors) {
+	m, collectors, err := newMetricsMiddleware(config)
+	if err != nil {
+		panic(err)
+	}
+	return m, collectors
+}
+
+// ErrorMetricsMiddleware returns an echo middleware only counting the requests failing with an error
+// or a 5xx status in the errors counter, for services instrumented elsewhere. The config labels,
+// handler label mapping, skipper, registry and Disabled are used, every other metric is disabled.
+// It panics when the config is not valid or the counter cannot be registered.
+func ErrorMetricsMiddleware(config Config) echo.MiddlewareFunc {
+	return MustMetricsMiddlewareWithConfig(Config{
+		Disabled:                  config.Disabled,
+		HandlerLabelMappingFunc:   config.HandlerLabelMappingFunc,
+		Skipper:                   config.Skipper,
+		Namespace:                 config.Namespace,
+		Subsystem:                 config.Subsystem,
+		NotFoundLabel:             config.NotFoundLabel,
+		MethodNotAllowedLabel:     config.MethodNotAllowedLabel,
+		DisableNotFoundCollapsing: config.DisableNotFoundCollapsing,
+		NotFoundLabelFunc:         config.NotFoundLabelFunc,
+		UnknownHandlerLabel:       config.UnknownHandlerLabel,
+		MaxHandlerCardinality:     config.MaxHandlerCardinality,
+		AllowedMethods:            config.AllowedMethods,
+		NormalizeMethod:           config.NormalizeMethod,
+		MethodLabelName:           config.MethodLabelName,
+		HandlerLabelName:          config.HandlerLabelName,
+		RecordErrorsWhenSkipped:   config.RecordErrorsWhenSkipped,
+		UseHTTPErrorCode:          config.UseHTTPErrorCode,
+		ConstLabels:               config.ConstLabels,
+		Registerer:                config.Registerer,
+		Gatherer:                  config.Gatherer,
+
+		DisableRequestCounter:    true,
+		DisableDurationHistogram: true,
+		DisableInFlightGauge:     true,
+		EnableErrorMetric:        true,
+		errorsOnly:               true,
+	})
+}
+
+// UnregisteredMetricsMiddleware returns an echo middleware for instrumentation and the collectors it records into,
+// without registering them. Collectors is itself a prometheus.Collector, to register when and where needed,
+// alone or within a custom collector. Registerer and Gatherer are ignored, Collectors.Gather only reads
+// the middleware metrics.
+func UnregisteredMetricsMiddleware(config Config) (echo.MiddlewareFunc, *Collectors, error) {
+	config.unregistered = true
+	return newMetricsMiddleware(config)
+}
+
+func newMetricsMiddleware(config Config) (echo.MiddlewareFunc, *Collectors, error) {
+	if config.Disabled {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}, &Collectors{gatherer: gathererFor(config)}, nil
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	config = withDefaults(config.snapshot())
+
+	registerer := config.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	if config.unregistered {
+		registry := prometheus.NewRegistry()
+		registerer = registry
+		config.Gatherer = registry
+	}
+
+	statusLabelNames, statusLabelValues := statusLabels(config)
+	var collectors *Collectors
+	extra := newExtraLabels(config, func() {
+		collectors.CardinalityLimitHits.Inc()
+	})
+
+	methodLabel := allowedMethods(config.AllowedMethods, config.NormalizeMethod)
+	handlers := newLabelLimiter(config.MaxHandlerCardinality)
+	collectors = newCollectors(config, statusLabelNames, extra.names)
+	if err := collectors.register(registerer); err != nil {
+		return nil, nil, err
+	}
+
+	if config.PushGateway != nil {
+		go collectors.pushPeriodically(*config.PushGateway)
+	}
+
+	handlerLabel := func(c echo.Context) string {
+		path := config.HandlerLabelMappingFunc(c)
+		// LimitedLabels flags the label it evicted, whose series are deleted off the request path
+		if evicted, ok := c.Get(evictedLabelKey).(string); ok {
+			c.Set(evictedLabelKey, nil)
+			collectors.evictions.add(strings.ToValidUTF8(evicted, "\uFFFD"))
+		}
+		if path == "" {
+			path = config.UnknownHandlerLabel
+		}
+
+		// to avoid attack high cardinality of 404
+		if !config.DisableNotFoundCollapsing && isNotFoundHandler(c.Handler()) {
+			path = config.NotFoundLabel
+			if config.NotFoundLabelFunc != nil {
+				if label := config.NotFoundLabelFunc(c); label != "" {
+					path = label
+				}
+			}
+		}
+		// the route path of a 405 is a real pattern, but scanners trying methods multiply its series
+		if !config.DisableNotFoundCollapsing && isMethodNotAllowedHandler(c.Handler()) {
+			path = config.MethodNotAllowedLabel
+		}
+		// prometheus panics on invalid UTF-8 label values, which raw paths like /%ff decode to
+		path = strings.ToValidUTF8(path, "\uFFFD")
+
+		if !handlers.allow(path) {
+			path = otherHandler
+			collectors.CardinalityLimitHits.Inc()
+		}
+		return path
+	}
+
+	// responseStatus returns the status written for the request, or the HTTP error code
+	// when none was written and UseHTTPErrorCode is set
+	responseStatus := func(c echo.Context, err error) int {
+		if config.UseHTTPErrorCode && !c.Response().Committed {
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				return he.Code
+			}
+		}
+		return c.Response().Status
+	}
+
+	// countRequest increments the requests and errors counters
+	countRequest := func(c echo.Context, status int, method, path string, extraValues []string, err error) {
+		if collectors.RequestsTotal != nil {
+			counterValues := extraValues
+			if config.OutcomeFunc != nil {
+				counterValues = append(extraValues[:len(extraValues):len(extraValues)], config.OutcomeFunc(c, err))
+			}
+			collectors.requestsCache.counter(collectors.RequestsTotal, statusLabelValues(status), method, path, counterValues).Inc()
+		}
+
+		if collectors.Errors != nil && (!config.errorsOnly || err != nil || status >= http.StatusInternalServerError) {
+			collectors.Errors.WithLabelValues(method, path, errorType(err)).Inc()
+		}
+	}
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			req := c.Request()
-			path := config.HandlerLabelMappingFunc(c)
 
-			// to avoid attack high cardinality of 404
-			if isNotFoundHandler(c.Handler()) {
-				path = notFoundPath
+			// skipped requests are not instrumented, the skipper runs before anything is measured
+			if config.Skipper(c) {
+				// mapped once, as LimitedLabels counts every call as a sighting
+				var path string
+				skippedLabel := func() string {
+					if path == "" {
+						path = handlerLabel(c)
+					}
+					return path
+				}
+				if collectors.LastRequestTimestamp != nil && config.RecordTimestampAlways {
+					collectors.LastRequestTimestamp.WithLabelValues(methodLabel(req.Method), skippedLabel()).Set(float64(config.NowFunc().Unix()))
+				}
+				afterFunc := config.AfterFunc != nil && config.AlwaysRunAfterFunc
+				if !afterFunc && !config.RecordErrorsWhenSkipped {
+					return next(c)
+				}
+
+				begin := config.NowFunc()
+				err := next(c)
+				dur := config.NowFunc().Sub(begin)
+				if err != nil {
+					c.Error(err)
+				}
+				status := responseStatus(c, err)
+				if config.RecordErrorsWhenSkipped && (err != nil || status >= http.StatusInternalServerError) {
+					countRequest(c, status, methodLabel(req.Method), skippedLabel(), extra.values(c, err), err)
+				}
+				if afterFunc {
+					config.AfterFunc(c, status, dur, err)
+				}
+				return err
+			}
+
+			method := methodLabel(req.Method)
+			path := handlerLabel(c)
+
+			if config.BeforeFunc != nil {
+				config.BeforeFunc(c, path)
+			}
+
+			var queued time.Duration
+			var hasQueueTime bool
+			if collectors.QueueTime != nil {
+				queued, hasQueueTime = queueTime(req.Header.Get(config.QueueTimeHeader), config.NowFunc())
+			}
+
+			if collectors.RequestsInFlight != nil {
+				inFlight := collectors.RequestsInFlight.WithLabelValues(method, path)
+				inFlight.Inc()
+				defer inFlight.Dec()
+			}
+
+			if collectors.inFlight != nil {
+				collectors.inFlight.inc()
+				defer collectors.inFlight.dec()
+			}
+
+			if collectors.Panics != nil && !config.InstrumentPanics {
+				defer func() {
+					if r := recover(); r != nil {
+						collectors.Panics.WithLabelValues(method, path).Inc()
+						panic(r)
+					}
+				}()
+			}
+
+			var ttfb *ttfbWriter
+			if collectors.TimeToFirstByte != nil {
+				res := c.Response()
+				ttfb = &ttfbWriter{ResponseWriter: res.Writer, now: config.NowFunc}
+				res.Writer = ttfb.wrap()
+				defer func() {
+					res.Writer = ttfb.ResponseWriter
+				}()
+			}
+
+			if collectors.RequestsStarted != nil {
+				collectors.RequestsStarted.WithLabelValues(method, path).Inc()
+			}
+
+			var requestPhases *phases
+			if collectors.PhaseDuration != nil {
+				requestPhases = &phases{now: config.NowFunc}
+				c.Set(phasesKey, requestPhases)
 			}
 
-			begin := time.Now()
+			begin := config.NowFunc()
+			if config.InstrumentPanics {
+				defer func() {
+					if r := recover(); r != nil {
+						collectors.Panics.WithLabelValues(method, path).Inc()
+						// the panic value stands for the error, the status is the one recover would answer
+						err := fmt.Errorf("panic: %v", r)
+						extraValues := extra.values(c, err)
+						if collectors.RequestDuration != nil {
+							observe(collectors.durationCache.observer(collectors.RequestDuration, method, path, extraValues), config.DurationUnit.value(config.NowFunc().Sub(begin)), nil)
+						}
+						countRequest(c, http.StatusInternalServerError, method, path, extraValues, err)
+						panic(r)
+					}
+				}()
+			}
 			err := next(c)
-			dur := time.Since(begin)
+			// measured before c.Error so error rendering is not part of the handler duration
+			dur := config.NowFunc().Sub(begin)
 
 			if err != nil {
 				c.Error(err)
 			}
 
-			if config.Skipper(c) {
-				return nil
+			if collectors.LastRequestTimestamp != nil {
+				collectors.LastRequestTimestamp.WithLabelValues(method, path).Set(float64(config.NowFunc().Unix()))
+			}
+
+			extraValues := extra.values(c, err)
+
+			// read after c.Error, which writes the error status unless the handler already committed one,
+			// so this is the status the client received, for returned errors, HTTP errors and committed
+			// responses followed by an error alike
+			status := responseStatus(c, err)
+			// like nginx, requests canceled by the client are not reported with the status written for them
+			if errors.Is(req.Context().Err(), context.Canceled) {
+				status = statusClientClosedRequest
+			}
+			// the duration of a hijacked connection is its lifetime, not the handler latency
+			websocket := collectors.WebsocketDuration != nil && isWebsocket(c)
+			hijacked := !websocket && isHijacked(c)
+			if websocket {
+				status = http.StatusSwitchingProtocols
+				collectors.WebsocketDuration.WithLabelValues(method, path).Observe(dur.Seconds())
+			} else if hijacked {
+				status = 0
+			}
+
+			// math/rand/v2 top level functions do not contend on a lock
+			if collectors.RequestDuration != nil && !hijacked && !websocket && (*config.SampleRate == 1 || rand.Float64() < *config.SampleRate) {
+				var exemplar prometheus.Labels
+				if config.ExemplarFunc != nil {
+					exemplar = config.ExemplarFunc(c)
+				}
+				observe(collectors.durationCache.observer(collectors.RequestDuration, method, path, extraValues), config.DurationUnit.value(dur), exemplar)
 			}
 
-			httpDuration.WithLabelValues(req.Method, path).Observe(dur.Seconds())
+			// the deadline is usually set by a handler or an inner middleware replacing the request
+			if collectors.DeadlineExceeded != nil && errors.Is(c.Request().Context().Err(), context.DeadlineExceeded) {
+				collectors.DeadlineExceeded.WithLabelValues(method, path).Inc()
+			}
 
-			status := ""
-			if config.NormalizeHTTPStatus {
-				status = normalizeHTTPStatus(c.Response().Status)
-			} else {
-				status = strconv.Itoa(c.Response().Status)
+			if collectors.LastRequestDuration != nil && !hijacked && !websocket {
+				collectors.LastRequestDuration.WithLabelValues(method, path).Set(dur.Seconds())
 			}
 
-			httpRequests.WithLabelValues(status, req.Method, path).Inc()
+			if collectors.SLOViolations != nil && !hijacked && !websocket && dur > config.SLOThreshold {
+				collectors.SLOViolations.WithLabelValues(method, path).Inc()
+			}
+
+			if ttfb != nil && !ttfb.firstByte.IsZero() {
+				collectors.TimeToFirstByte.WithLabelValues(method, path).Observe(ttfb.firstByte.Sub(begin).Seconds())
+			}
+
+			if requestPhases != nil {
+				collectors.PhaseDuration.WithLabelValues(method, path, handlerPhase).Observe(dur.Seconds())
+				for _, p := range requestPhases.durations {
+					collectors.PhaseDuration.WithLabelValues(method, path, p.phase).Observe(p.dur.Seconds())
+				}
+			}
+
+			if hasQueueTime {
+				collectors.QueueTime.WithLabelValues(method, path).Observe(queued.Seconds())
+			}
+
+			if collectors.RequestBytes != nil {
+				if req.ContentLength > 0 {
+					collectors.RequestBytes.WithLabelValues(method, path).Add(float64(req.ContentLength))
+				}
+				collectors.ResponseBytes.WithLabelValues(method, path).Add(float64(c.Response().Size))
+			}
+
+			if collectors.RequestSize != nil {
+				// unknown request sizes are reported as -1
+				if req.ContentLength >= 0 {
+					collectors.RequestSize.WithLabelValues(method, path).Observe(float64(req.ContentLength))
+				}
+				if config.EnableCompressedLabel {
+					collectors.ResponseSize.WithLabelValues(method, path, compressedLabel(c)).Observe(float64(c.Response().Size))
+				} else {
+					collectors.ResponseSize.WithLabelValues(method, path).Observe(float64(c.Response().Size))
+				}
+			}
+
+			countRequest(c, status, method, path, extraValues, err)
+
+			if collectors.RequestsByClass != nil {
+				collectors.RequestsByClass.WithLabelValues(statusClass(config, status)).Inc()
+			}
+
+			if config.AfterFunc != nil {
+				config.AfterFunc(c, status, dur, err)
+			}
 
 			return err
 		}
-	}
+	}, collectors, nil
 }
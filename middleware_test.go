@@ -0,0 +1,1182 @@
+package echoprometheus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestConfig returns the default config, registering on a new registry
+func newTestConfig() (Config, *prometheus.Registry) {
+	registry := prometheus.NewRegistry()
+	config := NewConfig()
+	config.Registerer = registry
+	return config, registry
+}
+
+// newTestServer returns an echo server instrumented with config, answering 200 on GET /foo,
+// and the collectors of its middleware
+func newTestServer(config Config) (*echo.Echo, *Collectors) {
+	metrics, collectors := MetricsMiddlewareWithCollectors(config)
+	e := echo.New()
+	e.Use(metrics)
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	return e, collectors
+}
+
+// serve sends a request to e and returns the recorded response
+func serve(e *echo.Echo, method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+// metricValue returns the sum of the counter and gauge series named name having all the labels
+func metricValue(t *testing.T, gatherer prometheus.Gatherer, name string, labels prometheus.Labels) float64 {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			matched := 0
+			for _, label := range m.GetLabel() {
+				if v, ok := labels[label.GetName()]; ok && v == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				value += m.GetCounter().GetValue() + m.GetGauge().GetValue()
+			}
+		}
+	}
+	return value
+}
+
+// seriesCount returns the number of series of the metric named name
+func seriesCount(t *testing.T, gatherer prometheus.Gatherer, name string) int {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return len(family.GetMetric())
+		}
+	}
+	return 0
+}
+
+// sampleSum returns the sum of the observations of the histogram or summary named name,
+// over all its series
+func sampleSum(t *testing.T, gatherer prometheus.Gatherer, name string) float64 {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			sum += m.GetHistogram().GetSampleSum() + m.GetSummary().GetSampleSum()
+		}
+	}
+	return sum
+}
+
+// sampleCount returns the number of observations of the histogram or summary named name,
+// summed over all its series
+func sampleCount(t *testing.T, gatherer prometheus.Gatherer, name string) uint64 {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			count += m.GetHistogram().GetSampleCount() + m.GetSummary().GetSampleCount()
+		}
+	}
+	return count
+}
+
+// skipHealth skips the /health route
+func skipHealth(c echo.Context) bool {
+	return c.Path() == "/health"
+}
+
+// fakeClock is a NowFunc only moving forward when advanced
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestCustomRegisterer(t *testing.T) {
+	config, registry := newTestConfig()
+	e, _ := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 1 {
+		t.Errorf("expected 1 request on the custom registry, got %v", value)
+	}
+	if n := seriesCount(t, prometheus.DefaultGatherer, "echo_http_requests_total"); n != 0 {
+		t.Errorf("expected nothing on the default registry, got %d series", n)
+	}
+}
+
+func TestMiddlewareCreatedTwice(t *testing.T) {
+	config, registry := newTestConfig()
+	first, _ := newTestServer(config)
+	second, _ := newTestServer(config)
+
+	serve(first, http.MethodGet, "/foo")
+	serve(second, http.MethodGet, "/foo")
+
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 2 {
+		t.Errorf("expected both middlewares to share the requests counter, got %v", value)
+	}
+}
+
+// blockingHandler returns a handler signaling entered when called and returning once release is closed
+func blockingHandler(entered chan<- struct{}, release <-chan struct{}) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		entered <- struct{}{}
+		<-release
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// serveBlocked serves n concurrent requests to /slow, calls f once they are all in the handler,
+// then lets them finish
+func serveBlocked(e *echo.Echo, n int, f func()) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	e.GET("/slow", blockingHandler(entered, release))
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(e, http.MethodGet, "/slow")
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-entered
+	}
+	f()
+	close(release)
+	wg.Wait()
+}
+
+func TestRequestsInFlight(t *testing.T) {
+	const n = 5
+	config, registry := newTestConfig()
+	e, _ := newTestServer(config)
+	slow := prometheus.Labels{"method": "GET", "handler": "/slow"}
+
+	serveBlocked(e, n, func() {
+		if value := metricValue(t, registry, "echo_http_requests_in_flight", slow); value != n {
+			t.Errorf("expected %d requests in flight, got %v", n, value)
+		}
+	})
+	if value := metricValue(t, registry, "echo_http_requests_in_flight", slow); value != 0 {
+		t.Errorf("expected no request in flight once served, got %v", value)
+	}
+}
+
+func TestSizeMetrics(t *testing.T) {
+	config, registry := newTestConfig()
+	config.EnableSizeMetrics = true
+	e, _ := newTestServer(config)
+	e.POST("/echo", func(c echo.Context) error {
+		return c.String(http.StatusOK, "hello")
+	})
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(strings.Repeat("a", 100))))
+	if sum := sampleSum(t, registry, "echo_http_request_size_bytes"); sum != 100 {
+		t.Errorf("expected a 100 bytes request, got %v", sum)
+	}
+	if sum := sampleSum(t, registry, "echo_http_response_size_bytes"); sum != 5 {
+		t.Errorf("expected a 5 bytes response, got %v", sum)
+	}
+
+	// unknown request sizes are not observed
+	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("body"))
+	req.ContentLength = -1
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	if count := sampleCount(t, registry, "echo_http_request_size_bytes"); count != 1 {
+		t.Errorf("expected the unknown request size not to be observed, got %d observations", count)
+	}
+	if count := sampleCount(t, registry, "echo_http_response_size_bytes"); count != 2 {
+		t.Errorf("expected 2 response sizes, got %d", count)
+	}
+}
+
+func TestZeroConfigDefaults(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	e, _ := newTestServer(Config{Namespace: "echo", Subsystem: "http", Registerer: registry})
+
+	if rec := serve(e, http.MethodGet, "/foo"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 1 {
+		t.Errorf("expected the request to be labeled with its path, got %v", value)
+	}
+	buckets, _ := histogramBuckets(t, registry, "echo_http_request_duration_seconds")
+	if !reflect.DeepEqual(buckets, DefaultBuckets()) {
+		t.Errorf("expected the default buckets, got %v", buckets)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := map[string]func(*Config){
+		"namespace":        func(c *Config) { c.Namespace = "my-app" },
+		"subsystem":        func(c *Config) { c.Subsystem = "1http" },
+		"unsorted buckets": func(c *Config) { c.Buckets = []float64{0.1, 1, 0.5} },
+		"equal buckets":    func(c *Config) { c.Buckets = []float64{0.1, 0.1} },
+		"summary max age":  func(c *Config) { c.SummaryMaxAge = -time.Second },
+		"summary buckets":  func(c *Config) { c.SummaryAgeBuckets = -1 },
+	}
+	for name, invalidate := range cases {
+		config := NewConfig()
+		invalidate(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+
+	if err := NewConfig().Validate(); err != nil {
+		t.Errorf("expected the default config to be valid, got %v", err)
+	}
+}
+
+func TestMetricsMiddlewareWithConfigPanicsOnInvalidConfig(t *testing.T) {
+	config, _ := newTestConfig()
+	config.Buckets = []float64{1, 0.5}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for unsorted buckets")
+		}
+	}()
+	MetricsMiddlewareWithConfig(config)
+}
+
+func BenchmarkIsNotFoundHandler(b *testing.B) {
+	handler := func(c echo.Context) error { return nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		isNotFoundHandler(handler)
+	}
+}
+
+// BenchmarkIsNotFoundHandlerUncached reflects on echo.NotFoundHandler on every call,
+// as isNotFoundHandler did before caching its pointer
+func BenchmarkIsNotFoundHandlerUncached(b *testing.B) {
+	handler := func(c echo.Context) error { return nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = reflect.ValueOf(handler).Pointer() == reflect.ValueOf(echo.NotFoundHandler).Pointer()
+	}
+}
+
+func TestIsNotFoundHandler(t *testing.T) {
+	if !isNotFoundHandler(echo.NotFoundHandler) {
+		t.Error("expected echo.NotFoundHandler to be detected")
+	}
+	if isNotFoundHandler(func(c echo.Context) error { return nil }) {
+		t.Error("expected another handler not to be detected")
+	}
+	if isNotFoundHandler(nil) {
+		t.Error("expected a nil handler not to be detected")
+	}
+}
+
+func TestErrorMetric(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableErrorMetric = true
+	e, collectors := newTestServer(config)
+	e.GET("/http", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	})
+	e.GET("/internal", func(c echo.Context) error {
+		return errors.New("failed")
+	})
+
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/http")
+	serve(e, http.MethodGet, "/internal")
+
+	for _, tc := range []struct{ handler, errorType string }{
+		{"/foo", "none"},
+		{"/http", "http"},
+		{"/internal", "internal"},
+	} {
+		if count := testutil.ToFloat64(collectors.Errors.WithLabelValues("GET", tc.handler, tc.errorType)); count != 1 {
+			t.Errorf("expected 1 %s error for %s, got %v", tc.errorType, tc.handler, count)
+		}
+	}
+	if count := testutil.CollectAndCount(collectors.Errors); count != 3 {
+		t.Errorf("expected 3 errors series, got %d", count)
+	}
+}
+
+// newPanicServer returns a server recovering panics outside of the metrics middleware,
+// with a /panic route
+func newPanicServer(config Config) (*echo.Echo, *Collectors) {
+	metrics, collectors := MetricsMiddlewareWithCollectors(config)
+	e := echo.New()
+	e.Use(middleware.Recover())
+	e.Use(metrics)
+	e.GET("/panic", func(c echo.Context) error {
+		panic("boom")
+	})
+	return e, collectors
+}
+
+func TestRecoverPanics(t *testing.T) {
+	for _, recoverPanics := range []bool{false, true} {
+		config, registry := newTestConfig()
+		config.RecoverPanics = recoverPanics
+		e, collectors := newPanicServer(config)
+
+		if rec := serve(e, http.MethodGet, "/panic"); rec.Code != http.StatusInternalServerError {
+			t.Errorf("RecoverPanics=%v: expected the recover middleware to answer 500, got %d", recoverPanics, rec.Code)
+		}
+		if value := testutil.ToFloat64(collectors.RequestsInFlight.WithLabelValues("GET", "/panic")); value != 0 {
+			t.Errorf("RecoverPanics=%v: expected no request in flight after a panic, got %v", recoverPanics, value)
+		}
+		panics := 0
+		if recoverPanics {
+			panics = 1
+		}
+		if n := seriesCount(t, registry, "echo_http_panics_total"); n != panics {
+			t.Errorf("RecoverPanics=%v: expected %d panics series, got %d", recoverPanics, panics, n)
+		}
+		if recoverPanics {
+			if count := testutil.ToFloat64(collectors.Panics.WithLabelValues("GET", "/panic")); count != 1 {
+				t.Errorf("expected 1 panic, got %v", count)
+			}
+		}
+	}
+}
+
+func TestInstrumentPanics(t *testing.T) {
+	config, registry := newTestConfig()
+	config.InstrumentPanics = true
+	metrics, collectors := MetricsMiddlewareWithCollectors(config)
+	// no recover middleware, the panic reaches the caller
+	e := echo.New()
+	e.Use(metrics)
+	e.GET("/panic", func(c echo.Context) error {
+		panic("boom")
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("expected the panic to propagate, got %v", r)
+			}
+		}()
+		serve(e, http.MethodGet, "/panic")
+	}()
+
+	if count := testutil.ToFloat64(collectors.Panics.WithLabelValues("GET", "/panic")); count != 1 {
+		t.Errorf("expected 1 panic, got %v", count)
+	}
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("5xx", "GET", "/panic")); count != 1 {
+		t.Errorf("expected the panicking request to be counted as a 5xx, got %v", count)
+	}
+	if count := sampleCount(t, registry, "echo_http_request_duration_seconds"); count != 1 {
+		t.Errorf("expected the panicking request duration to be observed, got %d observations", count)
+	}
+	if value := testutil.ToFloat64(collectors.RequestsInFlight.WithLabelValues("GET", "/panic")); value != 0 {
+		t.Errorf("expected no request in flight after a panic, got %v", value)
+	}
+}
+
+// afterCall is the arguments of an AfterFunc call
+type afterCall struct {
+	status int
+	dur    time.Duration
+	err    error
+}
+
+func TestAfterFunc(t *testing.T) {
+	handlerErr := echo.NewHTTPError(http.StatusConflict)
+	for _, always := range []bool{false, true} {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		config, _ := newTestConfig()
+		config.NowFunc = clock.Now
+		config.Skipper = skipHealth
+		config.AlwaysRunAfterFunc = always
+		var calls []afterCall
+		config.AfterFunc = func(c echo.Context, status int, dur time.Duration, err error) {
+			calls = append(calls, afterCall{status, dur, err})
+		}
+		e, _ := newTestServer(config)
+		e.GET("/conflict", func(c echo.Context) error {
+			clock.Advance(2 * time.Second)
+			return handlerErr
+		})
+		e.GET("/health", func(c echo.Context) error {
+			clock.Advance(time.Second)
+			return c.NoContent(http.StatusOK)
+		})
+
+		serve(e, http.MethodGet, "/conflict")
+		serve(e, http.MethodGet, "/health")
+
+		expected := []afterCall{{http.StatusConflict, 2 * time.Second, handlerErr}}
+		if always {
+			expected = append(expected, afterCall{http.StatusOK, time.Second, nil})
+		}
+		if !reflect.DeepEqual(calls, expected) {
+			t.Errorf("AlwaysRunAfterFunc=%v: expected calls %+v, got %+v", always, expected, calls)
+		}
+	}
+}
+
+func TestSkippedRequestReturnsError(t *testing.T) {
+	handlerErr := errors.New("failed")
+	configs := map[string]func(c *Config){
+		"skipped": func(c *Config) {},
+		"AlwaysRunAfterFunc": func(c *Config) {
+			c.AfterFunc = func(echo.Context, int, time.Duration, error) {}
+			c.AlwaysRunAfterFunc = true
+		},
+		"RecordErrorsWhenSkipped": func(c *Config) {
+			c.RecordErrorsWhenSkipped = true
+		},
+	}
+	for name, configure := range configs {
+		config, _ := newTestConfig()
+		config.Skipper = func(echo.Context) bool { return true }
+		configure(&config)
+		metrics := MetricsMiddlewareWithConfig(config)
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/foo", nil), httptest.NewRecorder())
+		if err := metrics(func(c echo.Context) error { return handlerErr })(c); err != handlerErr {
+			t.Errorf("%s: expected the handler error to be returned, got %v", name, err)
+		}
+	}
+}
+
+func TestBeforeFunc(t *testing.T) {
+	config, registry := newTestConfig()
+	config.Skipper = skipHealth
+	var labels []string
+	config.BeforeFunc = func(c echo.Context, handler string) {
+		labels = append(labels, handler)
+		c.Set("handler", handler)
+	}
+	e, _ := newTestServer(config)
+	var seen interface{}
+	e.GET("/users/:id", func(c echo.Context) error {
+		seen = c.Get("handler")
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/health", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	serve(e, http.MethodGet, "/users/42")
+	serve(e, http.MethodGet, "/health")
+
+	if !reflect.DeepEqual(labels, []string{"/users/:id"}) {
+		t.Fatalf("expected BeforeFunc to be called once with the handler label, got %v", labels)
+	}
+	if seen != "/users/:id" {
+		t.Errorf("expected BeforeFunc to run before the handler, got %v", seen)
+	}
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": labels[0]}); value != 1 {
+		t.Errorf("expected the request to be counted with the BeforeFunc label, got %v", value)
+	}
+}
+
+func TestHijackedConnection(t *testing.T) {
+	config, registry := newTestConfig()
+	recorded := make(chan struct{})
+	config.AfterFunc = func(echo.Context, int, time.Duration, error) {
+		close(recorded)
+	}
+	e, collectors := newTestServer(config)
+	e.GET("/upgrade", func(c echo.Context) error {
+		conn, rw, err := c.Response().Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: custom\r\n\r\n"); err != nil {
+			return err
+		}
+		return rw.Flush()
+	})
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/upgrade", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "custom")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	<-recorded
+
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("hijacked", "GET", "/upgrade")); count != 1 {
+		t.Errorf("expected 1 hijacked request, got %v", count)
+	}
+	if count := testutil.CollectAndCount(collectors.RequestsTotal); count != 1 {
+		t.Errorf("expected no other requests series, like a bogus 1xx one, got %d series", count)
+	}
+	if count := sampleCount(t, registry, "echo_http_request_duration_seconds"); count != 0 {
+		t.Errorf("expected the hijacked connection duration not to be observed, got %d observations", count)
+	}
+}
+
+// methodValues returns the method label values of the requests counter
+func methodValues(t *testing.T, gatherer prometheus.Gatherer) map[string]float64 {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "echo_http_requests_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "method" {
+					methods[label.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return methods
+}
+
+func TestAllowedMethods(t *testing.T) {
+	config, registry := newTestConfig()
+	e, _ := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+	serve(e, "FOOBAR", "/foo")
+	serve(e, "BAZ", "/foo")
+	if methods := methodValues(t, registry); !reflect.DeepEqual(methods, map[string]float64{"GET": 1, "other": 2}) {
+		t.Errorf("expected unknown methods to be labeled other, got %v", methods)
+	}
+
+	config, registry = newTestConfig()
+	config.AllowedMethods = []string{http.MethodPost}
+	e, _ = newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodPost, "/foo")
+	if methods := methodValues(t, registry); !reflect.DeepEqual(methods, map[string]float64{"POST": 1, "other": 1}) {
+		t.Errorf("expected methods outside AllowedMethods to be labeled other, got %v", methods)
+	}
+}
+
+func TestSubsystemsShareRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	e := echo.New()
+	for _, subsystem := range []string{"api", "admin"} {
+		config := NewConfig()
+		config.Registerer = registry
+		config.Subsystem = subsystem
+		metrics, err := MetricsMiddlewareWithConfigE(config)
+		if err != nil {
+			t.Fatalf("subsystem %s: %v", subsystem, err)
+		}
+		g := e.Group("/"+subsystem, metrics)
+		g.GET("/foo", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})
+	}
+
+	serve(e, http.MethodGet, "/api/foo")
+	serve(e, http.MethodGet, "/api/foo")
+	serve(e, http.MethodGet, "/admin/foo")
+
+	if count := sampleCount(t, registry, "echo_api_request_duration_seconds"); count != 2 {
+		t.Errorf("expected 2 api requests, got %d", count)
+	}
+	if count := sampleCount(t, registry, "echo_admin_request_duration_seconds"); count != 1 {
+		t.Errorf("expected 1 admin request, got %d", count)
+	}
+	if value := metricValue(t, registry, "echo_admin_requests_total", prometheus.Labels{"handler": "/admin/foo"}); value != 1 {
+		t.Errorf("expected 1 admin request in the admin subsystem, got %v", value)
+	}
+	if value := metricValue(t, registry, "echo_admin_requests_total", prometheus.Labels{"handler": "/api/foo"}); value != 0 {
+		t.Errorf("expected no api request in the admin subsystem, got %v", value)
+	}
+}
+
+func TestMaxHandlerCardinality(t *testing.T) {
+	config, registry := newTestConfig()
+	config.MaxHandlerCardinality = 2
+	config.HandlerLabelMappingFunc = func(c echo.Context) string {
+		return c.Request().URL.Path
+	}
+	e, collectors := newTestServer(config)
+	e.GET("/items/:id", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	for i := 1; i <= 5; i++ {
+		serve(e, http.MethodGet, "/items/"+strconv.Itoa(i))
+	}
+	// known values are still recorded under their own label
+	serve(e, http.MethodGet, "/items/1")
+
+	for handler, expected := range map[string]float64{"/items/1": 2, "/items/2": 1, "other": 3} {
+		if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": handler}); value != expected {
+			t.Errorf("expected %v requests labeled %s, got %v", expected, handler, value)
+		}
+	}
+	if n := seriesCount(t, registry, "echo_http_requests_total"); n != 3 {
+		t.Errorf("expected 3 requests series, got %d", n)
+	}
+	if hits := testutil.ToFloat64(collectors.CardinalityLimitHits); hits != 3 {
+		t.Errorf("expected 3 cardinality limit hits, got %v", hits)
+	}
+}
+
+func TestNormalizeMethod(t *testing.T) {
+	for normalize, expected := range map[bool]map[string]float64{
+		true: {"GET": 2},
+		// lowercase methods are not standard ones
+		false: {"GET": 1, "other": 1},
+	} {
+		config, registry := newTestConfig()
+		config.NormalizeMethod = normalize
+		e, _ := newTestServer(config)
+		serve(e, http.MethodGet, "/foo")
+		serve(e, "get", "/foo")
+
+		if methods := methodValues(t, registry); !reflect.DeepEqual(methods, expected) {
+			t.Errorf("NormalizeMethod=%v: expected methods %v, got %v", normalize, expected, methods)
+		}
+	}
+}
+
+func TestMetricsMiddlewareWithConfigE(t *testing.T) {
+	config, registry := newTestConfig()
+	config.Namespace = "my-app"
+	if m, err := MetricsMiddlewareWithConfigE(config); err == nil || m != nil {
+		t.Errorf("expected an error for the my-app namespace, got %v", err)
+	}
+	if families, _ := registry.Gather(); len(families) != 0 {
+		t.Errorf("expected nothing registered for an invalid config, got %d families", len(families))
+	}
+
+	// a requests counter with other labels can't be registered
+	config, registry = newTestConfig()
+	registry.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "echo",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests processed",
+	}, []string{"path"}))
+	if _, err := MetricsMiddlewareWithConfigE(config); err == nil {
+		t.Error("expected a registration error")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected MustMetricsMiddlewareWithConfig to panic on a registration error")
+		}
+	}()
+	MustMetricsMiddlewareWithConfig(config)
+}
+
+func TestRegistrationErrorUnregisters(t *testing.T) {
+	config, registry := newTestConfig()
+	config.EnableErrorMetric = true
+	// an errors counter with other labels can't be registered
+	registry.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "echo",
+		Subsystem: "http",
+		Name:      "errors_total",
+		Help:      "Number of HTTP requests failing",
+	}, []string{"path"}))
+	if _, err := MetricsMiddlewareWithConfigE(config); err == nil {
+		t.Fatal("expected a registration error")
+	}
+	// collectors are unregistered by descriptor, the name is enough to find the requests counter
+	if registry.Unregister(prometheus.NewCounter(prometheus.CounterOpts{Namespace: "echo", Subsystem: "http", Name: "requests_total"})) {
+		t.Error("expected the collectors registered before the error to be unregistered")
+	}
+
+	// the collectors reused from another middleware stay registered
+	config.EnableErrorMetric = false
+	e, _ := newTestServer(config)
+	config.EnableErrorMetric = true
+	if _, err := MetricsMiddlewareWithConfigE(config); err == nil {
+		t.Fatal("expected a registration error")
+	}
+	serve(e, http.MethodGet, "/foo")
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 1 {
+		t.Errorf("expected the requests counter of the first middleware to stay registered, got %v", value)
+	}
+}
+
+func TestSeparateWebsocketMetrics(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config, registry := newTestConfig()
+	config.NowFunc = clock.Now
+	config.StatusLabelMode = StatusLabelModeExact
+	config.SeparateWebsocketMetrics = true
+	e, collectors := newTestServer(config)
+	e.GET("/ws", func(c echo.Context) error {
+		// the connection lives for 30s
+		clock.Advance(30 * time.Second)
+		if c.QueryParam("hijack") != "" {
+			// nothing is written through the response once hijacked
+			return nil
+		}
+		if c.QueryParam("reject") != "" {
+			// the upgrader answers a failed handshake without switching protocols
+			return c.NoContent(http.StatusForbidden)
+		}
+		return c.NoContent(http.StatusSwitchingProtocols)
+	})
+
+	for _, target := range []string{"/ws", "/ws?hijack=1", "/ws?reject=1"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve(e, http.MethodGet, "/foo")
+
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("101", "GET", "/ws")); count != 2 {
+		t.Errorf("expected 2 upgrades counted with status 101, got %v", count)
+	}
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("403", "GET", "/ws")); count != 1 {
+		t.Errorf("expected the rejected handshake counted with status 403, got %v", count)
+	}
+	if sum := sampleSum(t, registry, "echo_http_websocket_connection_duration_seconds"); sum != 60 {
+		t.Errorf("expected two 30s connection lifetimes, got %vs", sum)
+	}
+	if count := sampleCount(t, registry, "echo_http_request_duration_seconds"); count != 2 {
+		t.Errorf("expected the rejected handshake and the /foo request in the duration histogram, got %d observations", count)
+	}
+}
+
+func TestRecordedStatusMatchesResponse(t *testing.T) {
+	handlerErr := errors.New("handler error")
+	cases := []struct {
+		name    string
+		handler echo.HandlerFunc
+		status  int
+	}{
+		{"nil with explicit status", func(c echo.Context) error {
+			return c.NoContent(http.StatusAccepted)
+		}, http.StatusAccepted},
+		{"HTTP error", func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusTeapot, "teapot")
+		}, http.StatusTeapot},
+		{"error", func(c echo.Context) error {
+			return handlerErr
+		}, http.StatusInternalServerError},
+		{"200 written then error", func(c echo.Context) error {
+			if err := c.String(http.StatusOK, "ok"); err != nil {
+				return err
+			}
+			return handlerErr
+		}, http.StatusOK},
+		{"200 written then HTTP error", func(c echo.Context) error {
+			if err := c.String(http.StatusOK, "ok"); err != nil {
+				return err
+			}
+			return echo.NewHTTPError(http.StatusBadGateway)
+		}, http.StatusOK},
+	}
+
+	for _, useHTTPErrorCode := range []bool{false, true} {
+		for _, tc := range cases {
+			t.Run(tc.name+"/UseHTTPErrorCode="+strconv.FormatBool(useHTTPErrorCode), func(t *testing.T) {
+				config, _ := newTestConfig()
+				config.StatusLabelMode = StatusLabelModeExact
+				config.UseHTTPErrorCode = useHTTPErrorCode
+				e, collectors := newTestServer(config)
+				e.GET("/status", tc.handler)
+
+				rec := serve(e, http.MethodGet, "/status")
+				if rec.Code != tc.status {
+					t.Fatalf("expected the client to receive %d, got %d", tc.status, rec.Code)
+				}
+				status := strconv.Itoa(rec.Code)
+				if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues(status, "GET", "/status")); count != 1 {
+					t.Errorf("expected 1 request with status %s, got %v", status, count)
+				}
+				if count := testutil.CollectAndCount(collectors.RequestsTotal); count != 1 {
+					t.Errorf("expected a single requests series, got %d", count)
+				}
+			})
+		}
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	rates := map[string]struct {
+		rate     *float64
+		expected uint64
+	}{
+		"zero":  {SampleRate(0), 0},
+		"one":   {SampleRate(1), 10},
+		"unset": {nil, 10},
+	}
+	for name, tc := range rates {
+		t.Run(name, func(t *testing.T) {
+			config, registry := newTestConfig()
+			config.SampleRate = tc.rate
+			e, collectors := newTestServer(config)
+			for i := 0; i < 10; i++ {
+				serve(e, http.MethodGet, "/foo")
+			}
+
+			if count := sampleCount(t, registry, "echo_http_request_duration_seconds"); count != tc.expected {
+				t.Errorf("expected %d observations, got %d", tc.expected, count)
+			}
+			if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/foo")); count != 10 {
+				t.Errorf("expected the requests counter not to be sampled, got %v", count)
+			}
+		})
+	}
+}
+
+func TestSampleRateDefaults(t *testing.T) {
+	if DefaultConfig.SampleRate != nil || NewConfig().SampleRate != nil {
+		t.Errorf("expected the default configs to sample every request with a nil rate")
+	}
+
+	// the middleware copies the rate
+	config, registry := newTestConfig()
+	config.SampleRate = SampleRate(1)
+	e, _ := newTestServer(config)
+	*config.SampleRate = 0
+	serve(e, http.MethodGet, "/foo")
+	if count := sampleCount(t, registry, "echo_http_request_duration_seconds"); count != 1 {
+		t.Errorf("expected the rate changed after creating the middleware to have no effect, got %d observations", count)
+	}
+
+	config.SampleRate = SampleRate(2)
+	if err := config.Validate(); err == nil {
+		t.Error("expected a sample rate above 1 to be invalid")
+	}
+}
+
+func TestSkippedRouteRecordsNothing(t *testing.T) {
+	config, registry := newTestConfig()
+	config.Skipper = skipHealth
+	calls := 0
+	config.NowFunc = func() time.Time {
+		calls++
+		return time.Unix(0, 0)
+	}
+	e, _ := newTestServer(config)
+	e.GET("/health", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	if rec := serve(e, http.MethodGet, "/health"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if calls != 0 {
+		t.Errorf("expected NowFunc not to be called for a skipped route, called %d times", calls)
+	}
+	for _, name := range []string{"echo_http_requests_total", "echo_http_request_duration_seconds", "echo_http_request_size_bytes", "echo_http_response_size_bytes"} {
+		if n := seriesCount(t, registry, name); n != 0 {
+			t.Errorf("expected no %s series for a skipped route, got %d", name, n)
+		}
+	}
+
+	serve(e, http.MethodGet, "/foo")
+	if calls == 0 {
+		t.Error("expected NowFunc to be called for an instrumented route")
+	}
+	if n := seriesCount(t, registry, "echo_http_requests_total"); n != 1 {
+		t.Errorf("expected 1 requests series, got %d", n)
+	}
+}
+
+func BenchmarkMiddlewareSkipped(b *testing.B) {
+	for _, target := range []string{"/foo", "/health"} {
+		b.Run(target, func(b *testing.B) {
+			config, _ := newTestConfig()
+			config.Skipper = skipHealth
+			e, _ := newTestServer(config)
+			e.GET("/health", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+			benchmarkServe(b, e, target)
+		})
+	}
+}
+
+func TestRecordErrorsWhenSkipped(t *testing.T) {
+	config, registry := newTestConfig()
+	config.RecordErrorsWhenSkipped = true
+	config.EnableErrorMetric = true
+	config.Skipper = func(c echo.Context) bool {
+		return strings.HasPrefix(c.Path(), "/noisy")
+	}
+	e, collectors := newTestServer(config)
+	e.GET("/noisy/ok", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/noisy/error", func(c echo.Context) error {
+		return errors.New("failed")
+	})
+	e.GET("/noisy/unavailable", func(c echo.Context) error {
+		return c.NoContent(http.StatusServiceUnavailable)
+	})
+	for _, target := range []string{"/noisy/ok", "/noisy/error", "/noisy/unavailable"} {
+		serve(e, http.MethodGet, target)
+	}
+
+	if count := testutil.ToFloat64(collectors.Errors.WithLabelValues("GET", "/noisy/error", "internal")); count != 1 {
+		t.Errorf("expected the skipped error to be counted, got %v", count)
+	}
+	for handler, expected := range map[string]float64{"/noisy/ok": 0, "/noisy/error": 1, "/noisy/unavailable": 1} {
+		if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": handler}); value != expected {
+			t.Errorf("expected %v requests counted for %s, got %v", expected, handler, value)
+		}
+	}
+	if count := sampleCount(t, registry, "echo_http_request_duration_seconds"); count != 0 {
+		t.Errorf("expected skipped requests not to be observed, got %d observations", count)
+	}
+}
+
+func TestErrorMetricsMiddleware(t *testing.T) {
+	config, registry := newTestConfig()
+	e := echo.New()
+	e.Use(ErrorMetricsMiddleware(config))
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/internal", func(c echo.Context) error {
+		return errors.New("failed")
+	})
+	e.GET("/unavailable", func(c echo.Context) error {
+		return c.NoContent(http.StatusServiceUnavailable)
+	})
+	for _, target := range []string{"/foo", "/internal", "/unavailable"} {
+		serve(e, http.MethodGet, target)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "echo_http_errors_total" {
+		t.Fatalf("expected only the errors counter to be registered, got %d families", len(families))
+	}
+	if count := seriesCount(t, registry, "echo_http_errors_total"); count != 2 {
+		t.Errorf("expected 2 errors series without the successful request, got %d", count)
+	}
+	if value := metricValue(t, registry, "echo_http_errors_total", prometheus.Labels{"handler": "/internal"}); value != 1 {
+		t.Errorf("expected 1 error for /internal, got %v", value)
+	}
+	if value := metricValue(t, registry, "echo_http_errors_total", prometheus.Labels{"handler": "/unavailable"}); value != 1 {
+		t.Errorf("expected 1 error for /unavailable, got %v", value)
+	}
+}
+
+func TestByteCounters(t *testing.T) {
+	config, registry := newTestConfig()
+	config.EnableByteCounters = true
+	e, _ := newTestServer(config)
+	e.POST("/echo", func(c echo.Context) error {
+		return c.String(http.StatusOK, "hello")
+	})
+
+	for _, size := range []int{100, 20, 0} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(strings.Repeat("a", size))))
+	}
+	// unknown request sizes are not added
+	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("body"))
+	req.ContentLength = -1
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	if value := metricValue(t, registry, "echo_http_request_bytes_total", prometheus.Labels{"handler": "/echo"}); value != 120 {
+		t.Errorf("expected 120 request bytes, got %v", value)
+	}
+	if value := metricValue(t, registry, "echo_http_response_bytes_total", prometheus.Labels{"handler": "/echo"}); value != 20 {
+		t.Errorf("expected 20 response bytes, got %v", value)
+	}
+}
+
+func TestDisabledRegistersNothing(t *testing.T) {
+	middlewares := map[string]func(Config) echo.MiddlewareFunc{
+		"MetricsMiddlewareWithConfig": MetricsMiddlewareWithConfig,
+		"ErrorMetricsMiddleware":      ErrorMetricsMiddleware,
+	}
+	for name, middleware := range middlewares {
+		t.Run(name, func(t *testing.T) {
+			config, registry := newTestConfig()
+			config.Disabled = true
+			e := echo.New()
+			e.Use(middleware(config))
+			e.GET("/foo", func(c echo.Context) error {
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			})
+
+			if rec := serve(e, http.MethodGet, "/foo"); rec.Code != http.StatusInternalServerError {
+				t.Errorf("expected the handler to still answer, got %d", rec.Code)
+			}
+			if count, err := testutil.GatherAndCount(registry); err != nil || count != 0 {
+				t.Errorf("expected no metric registered, got %d (%v)", count, err)
+			}
+		})
+	}
+}
+
+func TestCompressedLabel(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableSizeMetrics = true
+	config.EnableCompressedLabel = true
+	e, collectors := newTestServer(config)
+	e.Use(middleware.Gzip())
+	body := strings.Repeat("a", 1000)
+	e.GET("/big", func(c echo.Context) error {
+		return c.String(http.StatusOK, body)
+	})
+
+	for _, gzip := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodGet, "/big", nil)
+		if gzip {
+			req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if gzip && rec.Header().Get(echo.HeaderContentEncoding) != "gzip" {
+			t.Fatal("expected a gzip response")
+		}
+
+		h := observedHistogram(t, collectors.ResponseSize.WithLabelValues("GET", "/big", strconv.FormatBool(gzip)))
+		if h.GetSampleCount() != 1 {
+			t.Errorf("expected 1 response labeled compressed %v, got %d", gzip, h.GetSampleCount())
+		}
+		// the size written by the handler, before compression
+		if h.GetSampleSum() != float64(len(body)) {
+			t.Errorf("expected a %d bytes response labeled compressed %v, got %v", len(body), gzip, h.GetSampleSum())
+		}
+	}
+}
+
+func TestConfigChangedAfterCreation(t *testing.T) {
+	config, registry := newTestConfig()
+	config.Buckets = []float64{0.1, 1}
+	config.BucketsPerHandler = map[string][]float64{"/fast": {0.01}}
+	config.AllowedMethods = []string{http.MethodGet}
+	metrics, _ := MetricsMiddlewareWithCollectors(config)
+
+	// the histograms of new series would use the changed buckets if they were shared
+	config.Buckets[0] = 42
+	config.BucketsPerHandler["/fast"][0] = 42
+	config.AllowedMethods[0] = http.MethodPost
+	config.Skipper = func(echo.Context) bool { return true }
+
+	e := echo.New()
+	e.Use(metrics)
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/fast", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/fast")
+
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 1 {
+		t.Errorf("expected the request not to be skipped, got %v", value)
+	}
+	if methods := methodValues(t, registry); !reflect.DeepEqual(methods, map[string]float64{"GET": 2}) {
+		t.Errorf("expected the GET requests to keep their method, got %v", methods)
+	}
+	buckets := make(map[string][]float64)
+	for _, m := range durationFamily(t, registry).GetMetric() {
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "handler" {
+				for _, b := range m.GetHistogram().GetBucket() {
+					buckets[label.GetValue()] = append(buckets[label.GetValue()], b.GetUpperBound())
+				}
+			}
+		}
+	}
+	if expected := map[string][]float64{"/foo": {0.1, 1}, "/fast": {0.01}}; !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("expected the buckets %v, got %v", expected, buckets)
+	}
+}
+
+func TestDeadlineMetric(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableDeadlineMetric = true
+	e, collectors := newTestServer(config)
+	// withTimeout sets a timeout on the request, as a timeout middleware would
+	withTimeout := func(c echo.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		c.SetRequest(c.Request().WithContext(ctx))
+		return ctx, cancel
+	}
+	e.GET("/slow", func(c echo.Context) error {
+		ctx, cancel := withTimeout(c, time.Millisecond)
+		defer cancel()
+		<-ctx.Done()
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/fast", func(c echo.Context) error {
+		_, cancel := withTimeout(c, time.Hour)
+		defer cancel()
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/slow")
+	serve(e, http.MethodGet, "/fast")
+	serve(e, http.MethodGet, "/foo")
+
+	if count := testutil.ToFloat64(collectors.DeadlineExceeded.WithLabelValues("GET", "/slow")); count != 1 {
+		t.Errorf("expected the timed out request to be counted, got %v", count)
+	}
+	if count := testutil.CollectAndCount(collectors.DeadlineExceeded); count != 1 {
+		t.Errorf("expected only the timed out request to be counted, got %d series", count)
+	}
+}
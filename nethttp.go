@@ -0,0 +1,42 @@
+package echoprometheus
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultHTTPHandlerCardinality bounds the raw path handler labels of the net/http middleware
+const defaultHTTPHandlerCardinality = 100
+
+// NewHTTPMiddleware returns a net/http middleware recording the same metrics as the echo one,
+// for routes served outside of echo. Each request gets an echo context whose path is the request
+// URL path, so the config funcs work unchanged and the default handler label is the raw path:
+// set HandlerLabelMappingFunc, for instance to RegexpHandlerLabelMappingFunc, to normalize it.
+// As clients choose the paths, MaxHandlerCardinality defaults to 100, raise it when the mapped
+// labels are bounded. Requests are never collapsed as not found. It panics when the config is not valid.
+func NewHTTPMiddleware(config Config) func(http.Handler) http.Handler {
+	if config.MaxHandlerCardinality == 0 {
+		config.MaxHandlerCardinality = defaultHTTPHandlerCardinality
+	}
+	m := MetricsMiddlewareWithConfig(config)
+	e := echo.New()
+
+	return func(next http.Handler) http.Handler {
+		handler := func(c echo.Context) error {
+			next.ServeHTTP(c.Response(), c.Request())
+			return nil
+		}
+		instrumented := m(handler)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Reset defaults the status to 200 as echo does, for handlers writing nothing
+			c := e.AcquireContext()
+			defer e.ReleaseContext(c)
+			c.Reset(r, w)
+			c.SetPath(r.URL.Path)
+			c.SetHandler(handler)
+			_ = instrumented(c)
+		})
+	}
+}
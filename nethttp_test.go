@@ -0,0 +1,79 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewHTTPMiddleware(t *testing.T) {
+	config, registry := newTestConfig()
+	config.NormalizeHTTPStatus = false
+	config.EnableSizeMetrics = true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status/", func(w http.ResponseWriter, r *http.Request) {
+		code, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte("body"))
+	})
+	mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {})
+	handler := NewHTTPMiddleware(config)(mux)
+
+	for _, target := range []string{"/status/201", "/status/404", "/status/500", "/status/500", "/empty"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	for _, tc := range []struct {
+		status, handler string
+		expected        float64
+	}{
+		{"201", "/status/201", 1},
+		{"404", "/status/404", 1},
+		{"500", "/status/500", 2},
+		// handlers writing nothing answer 200
+		{"200", "/empty", 1},
+	} {
+		if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"status": tc.status, "handler": tc.handler}); value != tc.expected {
+			t.Errorf("expected %v %s requests to %s, got %v", tc.expected, tc.status, tc.handler, value)
+		}
+	}
+	if sum := sampleSum(t, registry, "echo_http_response_size_bytes"); sum != 16 {
+		t.Errorf("expected 16 bytes of responses, got %v", sum)
+	}
+}
+
+func TestNewHTTPMiddlewareInvalidUTF8Path(t *testing.T) {
+	config, registry := newTestConfig()
+	handler := NewHTTPMiddleware(config)(http.NotFoundHandler())
+
+	// the request URL path of /%ff is the single 0xff byte, invalid UTF-8
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/%ff", nil))
+
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"status": "4xx", "handler": "/\uFFFD"}); value != 1 {
+		t.Errorf("expected the invalid path to be counted as /\uFFFD, got %v", value)
+	}
+}
+
+func TestNewHTTPMiddlewareBoundedHandlers(t *testing.T) {
+	config, registry := newTestConfig()
+	handler := NewHTTPMiddleware(config)(http.NotFoundHandler())
+
+	for i := 0; i < defaultHTTPHandlerCardinality+10; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/"+strconv.Itoa(i), nil))
+	}
+
+	if count := seriesCount(t, registry, "echo_http_requests_total"); count != defaultHTTPHandlerCardinality+1 {
+		t.Errorf("expected %d handler series and other, got %d", defaultHTTPHandlerCardinality, count)
+	}
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"status": "4xx", "handler": otherHandler}); value != 10 {
+		t.Errorf("expected 10 requests past the limit counted as other, got %v", value)
+	}
+}
@@ -0,0 +1,110 @@
+package echoprometheus
+
+import (
+	"os"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option changes a field of the config used by New
+type Option func(*Config)
+
+// New returns an echo middleware for instrumentation, starting from DefaultConfig with
+// NormalizeMethod set and applying opts.
+func New(opts ...Option) echo.MiddlewareFunc {
+	config := NewConfig()
+	config.NormalizeMethod = true
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return MetricsMiddlewareWithConfig(config)
+}
+
+// WithNamespace sets the metrics namespace
+func WithNamespace(namespace string) Option {
+	return func(c *Config) {
+		c.Namespace = namespace
+	}
+}
+
+// WithSubsystem sets the metrics subsystem
+func WithSubsystem(subsystem string) Option {
+	return func(c *Config) {
+		c.Subsystem = subsystem
+	}
+}
+
+// WithBuckets sets the duration histogram buckets
+func WithBuckets(buckets []float64) Option {
+	return func(c *Config) {
+		c.Buckets = buckets
+	}
+}
+
+// WithDurationUnit sets the unit of the duration metric, the buckets default to the unit ones
+func WithDurationUnit(unit DurationUnit) Option {
+	return func(c *Config) {
+		c.DurationUnit = unit
+	}
+}
+
+// WithSkipper sets the skipper
+func WithSkipper(skipper middleware.Skipper) Option {
+	return func(c *Config) {
+		c.Skipper = skipper
+	}
+}
+
+// WithHandlerLabelFunc sets the function mapping a request to the handler label
+func WithHandlerLabelFunc(f func(c echo.Context) string) Option {
+	return func(c *Config) {
+		c.HandlerLabelMappingFunc = f
+	}
+}
+
+// WithNormalizeStatus sets whether the status label is the status class or the exact code
+func WithNormalizeStatus(normalize bool) Option {
+	return func(c *Config) {
+		c.NormalizeHTTPStatus = normalize
+	}
+}
+
+// WithNormalizeMethod sets whether the method is uppercased before becoming a label
+func WithNormalizeMethod(normalize bool) Option {
+	return func(c *Config) {
+		c.NormalizeMethod = normalize
+	}
+}
+
+// WithSampleRate sets the fraction of requests observed in the duration metric, between 0 and 1
+func WithSampleRate(rate float64) Option {
+	return func(c *Config) {
+		c.SampleRate = SampleRate(rate)
+	}
+}
+
+// WithExemplarFunc sets the function returning the exemplar labels of the duration observations
+func WithExemplarFunc(f func(c echo.Context) prometheus.Labels) Option {
+	return func(c *Config) {
+		c.ExemplarFunc = f
+	}
+}
+
+// WithEnvLabel adds a const label named key with the value of the envVarName environment variable,
+// read when the option is applied. The label is omitted when the variable is empty.
+func WithEnvLabel(key, envVarName string) Option {
+	return func(c *Config) {
+		value := os.Getenv(envVarName)
+		if value == "" {
+			return
+		}
+		labels := make(prometheus.Labels, len(c.ConstLabels)+1)
+		for name, v := range c.ConstLabels {
+			labels[name] = v
+		}
+		labels[key] = value
+		c.ConstLabels = labels
+	}
+}
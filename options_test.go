@@ -0,0 +1,150 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// withRegistry registers on registry
+func withRegistry(registry *prometheus.Registry) Option {
+	return func(c *Config) {
+		c.Registerer = registry
+	}
+}
+
+func TestNew(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	buckets := []float64{0.1, 1}
+	e := echo.New()
+	e.Use(New(
+		withRegistry(registry),
+		WithNamespace("app"),
+		WithSubsystem("api"),
+		WithBuckets(buckets),
+		WithNormalizeStatus(false),
+		WithHandlerLabelFunc(func(c echo.Context) string { return "handler" }),
+		WithSkipper(func(c echo.Context) bool { return c.Path() == "/health" }),
+	))
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusCreated)
+	})
+	e.GET("/health", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	serve(e, http.MethodGet, "/foo")
+	serve(e, http.MethodGet, "/health")
+
+	if value := metricValue(t, registry, "app_api_requests_total", prometheus.Labels{"handler": "handler"}); value != 1 {
+		t.Errorf("expected 1 request with the mapped handler label, got %v", value)
+	}
+	if n := seriesCount(t, registry, "app_api_requests_total"); n != 1 {
+		t.Errorf("expected the skipped request not to be recorded, got %d series", n)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "app_api_requests_total" {
+			continue
+		}
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			if label.GetName() == "status" && label.GetValue() != "201" {
+				t.Errorf("expected the exact status, got %s", label.GetValue())
+			}
+		}
+	}
+	if got, _ := histogramBuckets(t, registry, "app_api_request_duration_seconds"); !reflect.DeepEqual(got, buckets) {
+		t.Errorf("expected buckets %v, got %v", buckets, got)
+	}
+}
+
+func TestWithDurationUnit(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	e := echo.New()
+	e.Use(New(withRegistry(registry), WithDurationUnit(DurationMilliseconds)))
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/foo")
+
+	bounds, _ := histogramBuckets(t, registry, "echo_http_request_duration_milliseconds")
+	if bounds[len(bounds)-1] != 30000 {
+		t.Errorf("expected the default buckets in milliseconds, got %v", bounds)
+	}
+}
+
+func TestWithNormalizeMethod(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	e := echo.New()
+	// New normalizes methods by default
+	e.Use(New(withRegistry(registry)))
+	serve(e, "get", "/foo")
+	if methods := methodValues(t, registry); !reflect.DeepEqual(methods, map[string]float64{"GET": 1}) {
+		t.Errorf("expected New to normalize methods, got %v", methods)
+	}
+
+	config := NewConfig()
+	WithNormalizeMethod(true)(&config)
+	if !config.NormalizeMethod {
+		t.Error("expected WithNormalizeMethod(true) to enable the normalization")
+	}
+	WithNormalizeMethod(false)(&config)
+	if config.NormalizeMethod {
+		t.Error("expected WithNormalizeMethod(false) to disable the normalization")
+	}
+}
+
+func TestWithEnvLabel(t *testing.T) {
+	t.Setenv("ECHO_PROMETHEUS_ENV", "staging")
+	config := NewConfig()
+	labels := prometheus.Labels{"region": "eu"}
+	config.ConstLabels = labels
+	WithEnvLabel("env", "ECHO_PROMETHEUS_ENV")(&config)
+	if expected := (prometheus.Labels{"region": "eu", "env": "staging"}); !reflect.DeepEqual(config.ConstLabels, expected) {
+		t.Errorf("expected const labels %v, got %v", expected, config.ConstLabels)
+	}
+	if _, ok := labels["env"]; ok {
+		t.Error("expected the previous const labels not to be modified")
+	}
+
+	// an empty variable adds no label
+	t.Setenv("ECHO_PROMETHEUS_ENV", "")
+	config = NewConfig()
+	WithEnvLabel("env", "ECHO_PROMETHEUS_ENV")(&config)
+	if _, ok := config.ConstLabels["env"]; ok {
+		t.Errorf("expected no env label, got %v", config.ConstLabels)
+	}
+}
+
+func TestWithEnvLabelSeries(t *testing.T) {
+	t.Setenv("ECHO_PROMETHEUS_ENV", "production")
+	registry := prometheus.NewRegistry()
+	e := echo.New()
+	e.Use(New(withRegistry(registry), WithEnvLabel("env", "ECHO_PROMETHEUS_ENV")))
+	e.GET("/foo", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/foo")
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "echo_http_requests_total" {
+			continue
+		}
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			if label.GetName() == "env" && label.GetValue() == "production" {
+				return
+			}
+		}
+	}
+	t.Error("expected the requests to be labeled with the env variable")
+}
@@ -0,0 +1,23 @@
+// Package otel links echoprometheus metrics to OpenTelemetry traces through exemplars.
+// It is a separate module, so the core module does not depend on OpenTelemetry.
+package otel
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ExemplarFromContext returns the trace_id and span_id exemplar labels of the span in the request context,
+// or nil when there isn't one. Use it as echoprometheus.Config.ExemplarFunc.
+func ExemplarFromContext(c echo.Context) prometheus.Labels {
+	sc := trace.SpanContextFromContext(c.Request().Context())
+	if !sc.HasTraceID() {
+		return nil
+	}
+	labels := prometheus.Labels{"trace_id": sc.TraceID().String()}
+	if sc.HasSpanID() {
+		labels["span_id"] = sc.SpanID().String()
+	}
+	return labels
+}
@@ -0,0 +1,47 @@
+package otel
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func newContext(ctx context.Context) echo.Context {
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+func TestExemplarFromContextNoopTracer(t *testing.T) {
+	ctx, span := noop.NewTracerProvider().Tracer("test").Start(context.Background(), "request")
+	defer span.End()
+
+	if labels := ExemplarFromContext(newContext(ctx)); labels != nil {
+		t.Errorf("expected no exemplar for a noop span, got %v", labels)
+	}
+}
+
+func TestExemplarFromContextWithoutSpan(t *testing.T) {
+	if labels := ExemplarFromContext(newContext(context.Background())); labels != nil {
+		t.Errorf("expected no exemplar without span, got %v", labels)
+	}
+}
+
+func TestExemplarFromContext(t *testing.T) {
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{0x01, 0x02},
+		SpanID:  trace.SpanID{0x03},
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	labels := ExemplarFromContext(newContext(ctx))
+	if labels["trace_id"] != sc.TraceID().String() {
+		t.Errorf("expected trace_id %s, got %q", sc.TraceID(), labels["trace_id"])
+	}
+	if labels["span_id"] != sc.SpanID().String() {
+		t.Errorf("expected span_id %s, got %q", sc.SpanID(), labels["span_id"])
+	}
+}
@@ -0,0 +1,53 @@
+package echoprometheus
+
+import (
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// phasesKey is the context key of the request phases
+const phasesKey = "echoprometheus.phases"
+
+// handlerPhase is the phase of the whole next handler
+const handlerPhase = "handler"
+
+type phaseDuration struct {
+	phase string
+	dur   time.Duration
+}
+
+// phases records the sub-phases of a request marked with MeasureFrom and MeasureTo
+type phases struct {
+	now       func() time.Time
+	started   map[string]time.Time
+	durations []phaseDuration
+}
+
+// MeasureFrom marks the start of a request phase, measured until MeasureTo is called with the same phase.
+// It does nothing unless the request goes through a middleware with EnablePhaseMetrics.
+func MeasureFrom(c echo.Context, phase string) {
+	p, ok := c.Get(phasesKey).(*phases)
+	if !ok {
+		return
+	}
+	if p.started == nil {
+		p.started = make(map[string]time.Time)
+	}
+	p.started[phase] = p.now()
+}
+
+// MeasureTo marks the end of a request phase started by MeasureFrom, observed once the handler returns.
+// Phases never started are ignored.
+func MeasureTo(c echo.Context, phase string) {
+	p, ok := c.Get(phasesKey).(*phases)
+	if !ok {
+		return
+	}
+	start, ok := p.started[phase]
+	if !ok {
+		return
+	}
+	delete(p.started, phase)
+	p.durations = append(p.durations, phaseDuration{phase: phase, dur: p.now().Sub(start)})
+}
@@ -0,0 +1,65 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// observedHistogram returns the histogram observed through observer
+func observedHistogram(t *testing.T, observer prometheus.Observer) *dto.Histogram {
+	t.Helper()
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram()
+}
+
+func TestMeasurePhases(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config, _ := newTestConfig()
+	config.NowFunc = clock.Now
+	config.EnablePhaseMetrics = true
+	e, collectors := newTestServer(config)
+	e.GET("/phases", func(c echo.Context) error {
+		clock.Advance(time.Second)
+		MeasureFrom(c, "db")
+		clock.Advance(2 * time.Second)
+		MeasureTo(c, "db")
+		// never started
+		MeasureTo(c, "cache")
+		return c.NoContent(http.StatusOK)
+	})
+	serve(e, http.MethodGet, "/phases")
+
+	for phase, expected := range map[string]float64{"handler": 3, "db": 2} {
+		h := observedHistogram(t, collectors.PhaseDuration.WithLabelValues("GET", "/phases", phase))
+		if h.GetSampleCount() != 1 || h.GetSampleSum() != expected {
+			t.Errorf("expected a %vs %s phase, got %d observations summing to %vs", expected, phase, h.GetSampleCount(), h.GetSampleSum())
+		}
+	}
+	if h := observedHistogram(t, collectors.PhaseDuration.WithLabelValues("GET", "/phases", "cache")); h.GetSampleCount() != 0 {
+		t.Errorf("expected a phase never started not to be observed, got %d observations", h.GetSampleCount())
+	}
+}
+
+func TestMeasurePhasesDisabled(t *testing.T) {
+	config, registry := newTestConfig()
+	e, _ := newTestServer(config)
+	e.GET("/phases", func(c echo.Context) error {
+		MeasureFrom(c, "db")
+		MeasureTo(c, "db")
+		return c.NoContent(http.StatusOK)
+	})
+	if rec := serve(e, http.MethodGet, "/phases"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if n := seriesCount(t, registry, "echo_http_request_phase_duration_seconds"); n != 0 {
+		t.Errorf("expected no phase series without EnablePhaseMetrics, got %d", n)
+	}
+}
@@ -0,0 +1,66 @@
+package echoprometheus
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const defaultPushInterval = 15 * time.Second
+
+// PushGatewayConfig configures pushing the metrics to a Pushgateway in the background,
+// for short-lived services that cannot be scraped.
+type PushGatewayConfig struct {
+	// URL and Job identify the Pushgateway and the job the metrics are pushed under
+	URL string
+	Job string
+
+	// Interval between pushes, 15s when zero
+	Interval time.Duration
+
+	// Context stops the pushes when done, after a last push so the final counts are not lost.
+	// Pushes run until the process exits when nil.
+	Context context.Context
+
+	// ErrorHandler is called with the push errors, which are ignored when nil
+	ErrorHandler func(err error)
+}
+
+// PushToGateway pushes the metrics gathered from the collectors registry to a Pushgateway,
+// replacing the metrics previously pushed for the job.
+func (c *Collectors) PushToGateway(ctx context.Context, url, job string) error {
+	return push.New(url, job).Gatherer(c.gatherer).PushContext(ctx)
+}
+
+// pushPeriodically pushes the metrics every interval until the config context is done
+func (c *Collectors) pushPeriodically(config PushGatewayConfig) {
+	ctx := config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	interval := config.Interval
+	if interval <= 0 {
+		interval = defaultPushInterval
+	}
+
+	pushNow := func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, interval)
+		defer cancel()
+		if err := c.PushToGateway(ctx, config.URL, config.Job); err != nil && config.ErrorHandler != nil {
+			config.ErrorHandler(err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pushNow(ctx)
+		case <-ctx.Done():
+			pushNow(context.Background())
+			return
+		}
+	}
+}
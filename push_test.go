@@ -0,0 +1,124 @@
+package echoprometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// pushed is a push received by a stub Pushgateway
+type pushed struct {
+	method, path string
+	families     map[string]*dto.MetricFamily
+}
+
+// newPushGateway returns a stub Pushgateway sending the pushes it receives to the returned channel,
+// answering status
+func newPushGateway(t *testing.T, status int) (*httptest.Server, <-chan pushed) {
+	pushes := make(chan pushed, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := pushed{method: r.Method, path: r.URL.Path, families: make(map[string]*dto.MetricFamily)}
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var family dto.MetricFamily
+			if err := decoder.Decode(&family); err != nil {
+				break
+			}
+			p.families[family.GetName()] = &family
+		}
+		pushes <- p
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, pushes
+}
+
+func TestPushToGateway(t *testing.T) {
+	server, pushes := newPushGateway(t, http.StatusOK)
+	config, _ := newTestConfig()
+	e, collectors := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+
+	if err := collectors.PushToGateway(context.Background(), server.URL, "batch"); err != nil {
+		t.Fatal(err)
+	}
+	p := <-pushes
+	if p.method != http.MethodPut || p.path != "/metrics/job/batch" {
+		t.Errorf("expected a PUT to /metrics/job/batch, got a %s to %s", p.method, p.path)
+	}
+	family, ok := p.families["echo_http_requests_total"]
+	if !ok {
+		t.Fatalf("expected the requests counter to be pushed, got %v", p.families)
+	}
+	if value := family.GetMetric()[0].GetCounter().GetValue(); value != 1 {
+		t.Errorf("expected 1 pushed request, got %v", value)
+	}
+}
+
+func TestPushPeriodically(t *testing.T) {
+	server, pushes := newPushGateway(t, http.StatusOK)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config, _ := newTestConfig()
+	config.PushGateway = &PushGatewayConfig{URL: server.URL, Job: "batch", Interval: 10 * time.Millisecond, Context: ctx}
+	newTestServer(config)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pushes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected periodic pushes, got %d", i)
+		}
+	}
+}
+
+func TestPushOnContextDone(t *testing.T) {
+	server, pushes := newPushGateway(t, http.StatusOK)
+	ctx, cancel := context.WithCancel(context.Background())
+	config, _ := newTestConfig()
+	// no periodic push happens during the test
+	config.PushGateway = &PushGatewayConfig{URL: server.URL, Job: "batch", Interval: time.Hour, Context: ctx}
+	e, _ := newTestServer(config)
+	serve(e, http.MethodGet, "/foo")
+	cancel()
+
+	select {
+	case p := <-pushes:
+		family, ok := p.families["echo_http_requests_total"]
+		if !ok || family.GetMetric()[0].GetCounter().GetValue() != 1 {
+			t.Errorf("expected the final counts to be pushed, got %v", p.families)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a last push once the context is done")
+	}
+}
+
+func TestPushErrorHandler(t *testing.T) {
+	server, _ := newPushGateway(t, http.StatusInternalServerError)
+	errs := make(chan error, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config, _ := newTestConfig()
+	config.PushGateway = &PushGatewayConfig{
+		URL:          server.URL,
+		Job:          "batch",
+		Interval:     10 * time.Millisecond,
+		Context:      ctx,
+		ErrorHandler: func(err error) { errs <- err },
+	}
+	newTestServer(config)
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expected a push error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the error handler to be called")
+	}
+}
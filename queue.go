@@ -0,0 +1,40 @@
+package echoprometheus
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRequestStart parses the time a request entered the edge proxy, as set by nginx or HAProxy
+// in a header like X-Request-Start. Values are epoch seconds, milliseconds or microseconds,
+// optionally prefixed with t=, the unit is guessed from the magnitude.
+func parseRequestStart(value string) (time.Time, bool) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "t=")
+	epoch, err := strconv.ParseFloat(value, 64)
+	if err != nil || epoch <= 0 {
+		return time.Time{}, false
+	}
+
+	switch {
+	case epoch > 1e14:
+		epoch /= 1e6
+	case epoch > 1e11:
+		epoch /= 1e3
+	}
+	sec, frac := int64(epoch), epoch-float64(int64(epoch))
+	return time.Unix(sec, int64(frac*1e9)), true
+}
+
+// queueTime returns the time spent between the edge proxy and now, false when the header is absent,
+// unparseable or in the future
+func queueTime(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	start, ok := parseRequestStart(header)
+	if !ok || start.After(now) {
+		return 0, false
+	}
+	return now.Sub(start), true
+}
@@ -0,0 +1,55 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueueTime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for header, expected := range map[string]time.Duration{
+		"1699999999":         time.Second,
+		"t=1699999999":       time.Second,
+		"1699999999.75":      250 * time.Millisecond,
+		"1699999999500":      500 * time.Millisecond,
+		"t=1699999999500":    500 * time.Millisecond,
+		"1699999999500000":   500 * time.Millisecond,
+		"t=1699999999500000": 500 * time.Millisecond,
+		" t=1699999999 ":     time.Second,
+	} {
+		if d, ok := queueTime(header, now); !ok || d != expected {
+			t.Errorf("expected %q to be queued %v, got %v, %v", header, expected, d, ok)
+		}
+	}
+
+	for _, header := range []string{"", "garbage", "t=", "0", "-1699999999", "1700000001"} {
+		if d, ok := queueTime(header, now); ok {
+			t.Errorf("expected %q not to be parsed, got %v", header, d)
+		}
+	}
+}
+
+func TestQueueTimeObserved(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	config, registry := newTestConfig()
+	config.NowFunc = clock.Now
+	config.QueueTimeHeader = "X-Request-Start"
+	e, _ := newTestServer(config)
+
+	for _, header := range []string{"t=1699999999500", "", "garbage"} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		if header != "" {
+			req.Header.Set("X-Request-Start", header)
+		}
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if count := sampleCount(t, registry, "echo_http_queue_time_seconds"); count != 1 {
+		t.Errorf("expected absent and unparseable headers not to be observed, got %d observations", count)
+	}
+	if sum := sampleSum(t, registry, "echo_http_queue_time_seconds"); sum != 0.5 {
+		t.Errorf("expected a 0.5s queue time, got %vs", sum)
+	}
+}
@@ -0,0 +1,70 @@
+package echoprometheus
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const defaultMetricsPath = "/metrics"
+
+// SkipMetricsEndpoint returns a skipper matching the metrics endpoint path, /metrics when path is empty.
+func SkipMetricsEndpoint(path string) middleware.Skipper {
+	if path == "" {
+		path = defaultMetricsPath
+	}
+	return func(c echo.Context) bool {
+		return c.Path() == path
+	}
+}
+
+// CombineSkippers returns a skipper that skips when any of the skippers does
+func CombineSkippers(skippers ...middleware.Skipper) middleware.Skipper {
+	return func(c echo.Context) bool {
+		for _, skipper := range skippers {
+			if skipper(c) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SkipPaths returns a skipper matching the route paths exactly.
+func SkipPaths(paths ...string) middleware.Skipper {
+	skipped := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		skipped[path] = struct{}{}
+	}
+	return func(c echo.Context) bool {
+		_, ok := skipped[c.Path()]
+		return ok
+	}
+}
+
+// SkipPrefixes returns a skipper matching the route paths starting with any of the prefixes.
+func SkipPrefixes(prefixes ...string) middleware.Skipper {
+	return func(c echo.Context) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(c.Path(), prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SkipRegexp returns a skipper matching the route paths against the pattern, which is not anchored,
+// or an error when the pattern does not compile.
+func SkipRegexp(pattern string) (middleware.Skipper, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid skip pattern: %w", err)
+	}
+	return func(c echo.Context) bool {
+		return re.MatchString(c.Path())
+	}, nil
+}
@@ -0,0 +1,125 @@
+package echoprometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// contextWithPath returns a context whose route path is path
+func contextWithPath(path string) echo.Context {
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+	c.SetPath(path)
+	return c
+}
+
+func TestSkipMetricsEndpoint(t *testing.T) {
+	if !SkipMetricsEndpoint("")(contextWithPath("/metrics")) {
+		t.Error("expected /metrics to be skipped by default")
+	}
+	if SkipMetricsEndpoint("")(contextWithPath("/foo")) {
+		t.Error("expected /foo not to be skipped")
+	}
+	skipper := SkipMetricsEndpoint("/internal/metrics")
+	if !skipper(contextWithPath("/internal/metrics")) || skipper(contextWithPath("/metrics")) {
+		t.Error("expected only the configured path to be skipped")
+	}
+}
+
+func TestSkipMetricsEndpointRecordsNothing(t *testing.T) {
+	config, registry := newTestConfig()
+	config.Skipper = SkipMetricsEndpoint("")
+	e, _ := newTestServer(config)
+	e.GET("/metrics", MetricsHandlerWithConfig(config))
+
+	serve(e, http.MethodGet, "/metrics")
+	serve(e, http.MethodGet, "/foo")
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/metrics"}); value != 0 {
+		t.Errorf("expected the metrics endpoint not to be recorded, got %v", value)
+	}
+	if value := metricValue(t, registry, "echo_http_requests_total", prometheus.Labels{"handler": "/foo"}); value != 1 {
+		t.Errorf("expected 1 /foo request, got %v", value)
+	}
+}
+
+func TestCombineSkippers(t *testing.T) {
+	skipper := CombineSkippers(SkipMetricsEndpoint(""), func(c echo.Context) bool {
+		return c.Path() == "/health"
+	})
+	for path, skipped := range map[string]bool{"/metrics": true, "/health": true, "/foo": false} {
+		if skipper(contextWithPath(path)) != skipped {
+			t.Errorf("expected %s skipped to be %v", path, skipped)
+		}
+	}
+	if CombineSkippers()(contextWithPath("/foo")) {
+		t.Error("expected no skipper to skip nothing")
+	}
+}
+
+func TestSkipPaths(t *testing.T) {
+	skipper := SkipPaths("/health", "/ready")
+	for path, skipped := range map[string]bool{
+		"/health":     true,
+		"/ready":      true,
+		"/health/":    false,
+		"/healthz":    false,
+		"/api/health": false,
+		"/foo":        false,
+	} {
+		if skipper(contextWithPath(path)) != skipped {
+			t.Errorf("expected %s skipped to be %v", path, skipped)
+		}
+	}
+}
+
+func TestSkipPrefixes(t *testing.T) {
+	skipper := SkipPrefixes("/internal/", "/debug")
+	for path, skipped := range map[string]bool{
+		"/internal/metrics": true,
+		"/debug":            true,
+		"/debug/pprof/":     true,
+		"/internal":         false,
+		"/api/debug":        false,
+	} {
+		if skipper(contextWithPath(path)) != skipped {
+			t.Errorf("expected %s skipped to be %v", path, skipped)
+		}
+	}
+	if !CombineSkippers(SkipPaths("/health"), SkipPrefixes("/debug"))(contextWithPath("/health")) {
+		t.Error("expected the skippers to combine")
+	}
+}
+
+func TestSkipRegexp(t *testing.T) {
+	skipper, err := SkipRegexp(`^/internal/.*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, skipped := range map[string]bool{
+		"/internal/metrics": true,
+		"/internal/":        true,
+		"/internal":         false,
+		"/api/internal/foo": false,
+		"/foo":              false,
+	} {
+		if skipper(contextWithPath(path)) != skipped {
+			t.Errorf("expected %s skipped to be %v", path, skipped)
+		}
+	}
+
+	// the pattern is not anchored
+	skipper, err = SkipRegexp(`/debug`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !skipper(contextWithPath("/api/debug/vars")) {
+		t.Error("expected an unanchored pattern to match anywhere in the path")
+	}
+
+	if skipper, err := SkipRegexp(`/users/(`); err == nil || skipper != nil {
+		t.Errorf("expected an error for an invalid pattern, got %v", err)
+	}
+}
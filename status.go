@@ -0,0 +1,104 @@
+package echoprometheus
+
+import "strconv"
+
+// StatusLabelMode defines the status labels of the requests counter
+type StatusLabelMode int
+
+const (
+	// StatusLabelModeAuto uses a status label following StatusLabelFunc and NormalizeHTTPStatus
+	StatusLabelModeAuto StatusLabelMode = iota
+	// StatusLabelModeClass uses a status label with the status class, like 2xx
+	StatusLabelModeClass
+	// StatusLabelModeExact uses a status label with the exact status code
+	StatusLabelModeExact
+	// StatusLabelModeBoth uses both status_class and status_code labels.
+	// It increases the number of series, as each class is split by every code seen.
+	StatusLabelModeBoth
+)
+
+// NormalizeHTTPStatus returns the status class, like 2xx or 5xx
+// nolint: gomnd
+func NormalizeHTTPStatus(status int) string {
+	if status < 200 {
+		return "1xx"
+	} else if status < 300 {
+		return "2xx"
+	} else if status < 400 {
+		return "3xx"
+	} else if status < 500 {
+		return "4xx"
+	}
+	return "5xx"
+}
+
+// statusLabels returns the status label names of the requests counter and the function computing their values.
+// Status 0, used for hijacked connections, is labeled with HijackedStatusLabel.
+func statusLabels(config Config) ([]string, func(status int) []string) {
+	names, values := statusLabelsByMode(config)
+	return names, func(status int) []string {
+		if status == 0 {
+			labels := make([]string, len(names))
+			for i := range labels {
+				labels[i] = config.HijackedStatusLabel
+			}
+			return labels
+		}
+		return values(status)
+	}
+}
+
+// statusClass returns the status class, or HijackedStatusLabel for status 0
+func statusClass(config Config, status int) string {
+	if status == 0 {
+		return config.HijackedStatusLabel
+	}
+	return NormalizeHTTPStatus(status)
+}
+
+func statusLabelsByMode(config Config) ([]string, func(status int) []string) {
+	switch config.StatusLabelMode {
+	case StatusLabelModeClass:
+		normalize := preserveStatusCodes(config.PreserveStatusCodes)
+		return []string{config.StatusLabelName}, func(status int) []string {
+			return []string{normalize(status)}
+		}
+	case StatusLabelModeExact:
+		return []string{config.StatusLabelName}, func(status int) []string {
+			return []string{strconv.Itoa(status)}
+		}
+	case StatusLabelModeBoth:
+		return []string{"status_class", "status_code"}, func(status int) []string {
+			return []string{NormalizeHTTPStatus(status), strconv.Itoa(status)}
+		}
+	}
+
+	statusLabel := config.StatusLabelFunc
+	if statusLabel == nil {
+		if config.NormalizeHTTPStatus {
+			statusLabel = preserveStatusCodes(config.PreserveStatusCodes)
+		} else {
+			statusLabel = strconv.Itoa
+		}
+	}
+	return []string{config.StatusLabelName}, func(status int) []string {
+		return []string{statusLabel(status)}
+	}
+}
+
+// preserveStatusCodes returns NormalizeHTTPStatus keeping the exact value of the codes
+func preserveStatusCodes(codes []int) func(status int) string {
+	if len(codes) == 0 {
+		return NormalizeHTTPStatus
+	}
+	preserved := make(map[int]string, len(codes))
+	for _, code := range codes {
+		preserved[code] = strconv.Itoa(code)
+	}
+	return func(status int) string {
+		if label, ok := preserved[status]; ok {
+			return label
+		}
+		return NormalizeHTTPStatus(status)
+	}
+}
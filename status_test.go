@@ -0,0 +1,226 @@
+package echoprometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNormalizeHTTPStatus(t *testing.T) {
+	for status, class := range map[int]string{
+		100: "1xx",
+		200: "2xx",
+		204: "2xx",
+		301: "3xx",
+		404: "4xx",
+		500: "5xx",
+		503: "5xx",
+	} {
+		if label := NormalizeHTTPStatus(status); label != class {
+			t.Errorf("expected %d to be normalized to %s, got %s", status, class, label)
+		}
+	}
+}
+
+// newStatusServer returns a server with a /status/:code route answering code
+func newStatusServer(config Config) (*echo.Echo, *Collectors) {
+	e, collectors := newTestServer(config)
+	e.GET("/status/:code", func(c echo.Context) error {
+		code, err := strconv.Atoi(c.Param("code"))
+		if err != nil {
+			return err
+		}
+		return c.NoContent(code)
+	})
+	return e, collectors
+}
+
+func TestStatusLabelFunc(t *testing.T) {
+	config, _ := newTestConfig()
+	config.StatusLabelFunc = func(status int) string {
+		if status >= http.StatusBadRequest {
+			return "error"
+		}
+		return "ok"
+	}
+	e, collectors := newStatusServer(config)
+	serve(e, http.MethodGet, "/status/200")
+	serve(e, http.MethodGet, "/status/404")
+	serve(e, http.MethodGet, "/status/500")
+
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("ok", "GET", "/status/:code")); count != 1 {
+		t.Errorf("expected 1 ok request, got %v", count)
+	}
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("error", "GET", "/status/:code")); count != 2 {
+		t.Errorf("expected 2 error requests, got %v", count)
+	}
+}
+
+func TestStatusNotNormalized(t *testing.T) {
+	config, _ := newTestConfig()
+	config.NormalizeHTTPStatus = false
+	e, collectors := newStatusServer(config)
+	serve(e, http.MethodGet, "/status/201")
+
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("201", "GET", "/status/:code")); count != 1 {
+		t.Errorf("expected 1 request with status 201, got %v", count)
+	}
+}
+
+func TestStatusLabelMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode   StatusLabelMode
+		labels []string
+	}{
+		{StatusLabelModeClass, []string{"4xx"}},
+		{StatusLabelModeExact, []string{"404"}},
+		{StatusLabelModeBoth, []string{"4xx", "404"}},
+	} {
+		config, _ := newTestConfig()
+		config.StatusLabelMode = tc.mode
+		// the mode takes precedence over the status label func
+		config.StatusLabelFunc = func(int) string { return "ignored" }
+		e, collectors := newStatusServer(config)
+		serve(e, http.MethodGet, "/status/404")
+
+		values := append(tc.labels, "GET", "/status/:code")
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues(values...)); count != 1 {
+			t.Errorf("mode %d: expected 1 request labeled %v, got %v", tc.mode, values, count)
+		}
+	}
+}
+
+func TestStatusLabelModeBothLabelNames(t *testing.T) {
+	config, registry := newTestConfig()
+	config.StatusLabelMode = StatusLabelModeBoth
+	e, _ := newStatusServer(config)
+	serve(e, http.MethodGet, "/status/200")
+
+	expected := `
+# HELP echo_http_requests_total Number of HTTP requests processed
+# TYPE echo_http_requests_total counter
+echo_http_requests_total{handler="/status/:code",method="GET",status_class="2xx",status_code="200"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "echo_http_requests_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClassOnlyCounter(t *testing.T) {
+	config, _ := newTestConfig()
+	config.EnableClassOnlyCounter = true
+	config.StatusLabelMode = StatusLabelModeExact
+	e, collectors := newStatusServer(config)
+	for _, target := range []string{"/foo", "/status/201", "/status/404", "/status/410", "/status/500"} {
+		serve(e, http.MethodGet, target)
+	}
+
+	for class, expected := range map[string]float64{"2xx": 2, "4xx": 2, "5xx": 1} {
+		if count := testutil.ToFloat64(collectors.RequestsByClass.WithLabelValues(class)); count != expected {
+			t.Errorf("expected %v %s requests, got %v", expected, class, count)
+		}
+	}
+	// both counters move together
+	var total float64
+	for _, class := range []string{"2xx", "4xx", "5xx"} {
+		total += testutil.ToFloat64(collectors.RequestsByClass.WithLabelValues(class))
+	}
+	var detailedTotal float64
+	for _, status := range []string{"200", "201", "404", "410", "500"} {
+		handler := "/status/:code"
+		if status == "200" {
+			handler = "/foo"
+		}
+		detailedTotal += testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues(status, "GET", handler))
+	}
+	if total != detailedTotal {
+		t.Errorf("expected the class counter total %v to match the detailed total %v", total, detailedTotal)
+	}
+}
+
+func TestClientClosedRequest(t *testing.T) {
+	config, _ := newTestConfig()
+	config.StatusLabelMode = StatusLabelModeExact
+	e, collectors := newStatusServer(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e.GET("/canceled", func(c echo.Context) error {
+		// the client goes away while the handler runs
+		cancel()
+		<-c.Request().Context().Done()
+		return c.Request().Context().Err()
+	})
+
+	serve(e, http.MethodGet, "/foo")
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/canceled", nil).WithContext(ctx))
+
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("499", "GET", "/canceled")); count != 1 {
+		t.Errorf("expected the canceled request to be labeled 499, got %v", count)
+	}
+	if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("200", "GET", "/foo")); count != 1 {
+		t.Errorf("expected the other request to keep its status, got %v", count)
+	}
+	if count := testutil.CollectAndCount(collectors.RequestsTotal); count != 2 {
+		t.Errorf("expected no 5xx series for the canceled request, got %d series", count)
+	}
+}
+
+func TestUseHTTPErrorCode(t *testing.T) {
+	for _, useHTTPErrorCode := range []bool{false, true} {
+		config, _ := newTestConfig()
+		config.UseHTTPErrorCode = useHTTPErrorCode
+		e, collectors := newTestServer(config)
+		// an error handler rendering nothing, leaving the error responses uncommitted
+		e.HTTPErrorHandler = func(err error, c echo.Context) {}
+		e.GET("/before", func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusNotFound)
+		})
+		e.GET("/after", func(c echo.Context) error {
+			if err := c.NoContent(http.StatusOK); err != nil {
+				return err
+			}
+			return echo.NewHTTPError(http.StatusNotFound)
+		})
+		serve(e, http.MethodGet, "/before")
+		serve(e, http.MethodGet, "/after")
+
+		before := "2xx"
+		if useHTTPErrorCode {
+			before = "4xx"
+		}
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues(before, "GET", "/before")); count != 1 {
+			t.Errorf("expected the uncommitted error to be labeled %s with UseHTTPErrorCode %v, got %v", before, useHTTPErrorCode, count)
+		}
+		// the committed status is kept
+		if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues("2xx", "GET", "/after")); count != 1 {
+			t.Errorf("expected the committed response to be labeled 2xx with UseHTTPErrorCode %v, got %v", useHTTPErrorCode, count)
+		}
+	}
+}
+
+func TestPreserveStatusCodes(t *testing.T) {
+	for _, mode := range []StatusLabelMode{StatusLabelModeAuto, StatusLabelModeClass} {
+		config, _ := newTestConfig()
+		config.StatusLabelMode = mode
+		config.PreserveStatusCodes = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+		e, collectors := newStatusServer(config)
+		for _, code := range []string{"429", "503", "404", "500"} {
+			serve(e, http.MethodGet, "/status/"+code)
+		}
+
+		for _, label := range []string{"429", "503", "4xx", "5xx"} {
+			if count := testutil.ToFloat64(collectors.RequestsTotal.WithLabelValues(label, "GET", "/status/:code")); count != 1 {
+				t.Errorf("mode %d: expected 1 request labeled %s, got %v", mode, label, count)
+			}
+		}
+		if count := testutil.CollectAndCount(collectors.RequestsTotal); count != 4 {
+			t.Errorf("mode %d: expected 4 series, got %d", mode, count)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package echoprometheus
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// ttfbWriter records when the first byte, header included, is written
+type ttfbWriter struct {
+	http.ResponseWriter
+	now       func() time.Time
+	firstByte time.Time
+}
+
+func (w *ttfbWriter) mark() {
+	if w.firstByte.IsZero() {
+		w.firstByte = w.now()
+	}
+}
+
+func (w *ttfbWriter) WriteHeader(code int) {
+	w.mark()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ttfbWriter) Write(b []byte) (int, error) {
+	w.mark()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap is used by http.ResponseController
+func (w *ttfbWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ttfbFlusher and ttfbReaderFrom mark the first byte before calling the wrapped writer
+type ttfbFlusher struct{ *ttfbWriter }
+
+func (w ttfbFlusher) Flush() {
+	w.mark()
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+type ttfbReaderFrom struct{ *ttfbWriter }
+
+func (w ttfbReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	w.mark()
+	return w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+}
+
+// wrap returns w as a writer implementing the same optional interfaces as the wrapped one among
+// http.Flusher, http.Hijacker and io.ReaderFrom, so interface checks on it keep their answer
+func (w *ttfbWriter) wrap() http.ResponseWriter {
+	hijacker, isHijacker := w.ResponseWriter.(http.Hijacker)
+	_, isFlusher := w.ResponseWriter.(http.Flusher)
+	_, isReaderFrom := w.ResponseWriter.(io.ReaderFrom)
+	flusher, readerFrom := ttfbFlusher{w}, ttfbReaderFrom{w}
+
+	switch {
+	case isFlusher && isHijacker && isReaderFrom:
+		return struct {
+			*ttfbWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, flusher, hijacker, readerFrom}
+	case isFlusher && isHijacker:
+		return struct {
+			*ttfbWriter
+			http.Flusher
+			http.Hijacker
+		}{w, flusher, hijacker}
+	case isFlusher && isReaderFrom:
+		return struct {
+			*ttfbWriter
+			http.Flusher
+			io.ReaderFrom
+		}{w, flusher, readerFrom}
+	case isHijacker && isReaderFrom:
+		return struct {
+			*ttfbWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{w, hijacker, readerFrom}
+	case isFlusher:
+		return struct {
+			*ttfbWriter
+			http.Flusher
+		}{w, flusher}
+	case isHijacker:
+		return struct {
+			*ttfbWriter
+			http.Hijacker
+		}{w, hijacker}
+	case isReaderFrom:
+		return struct {
+			*ttfbWriter
+			io.ReaderFrom
+		}{w, readerFrom}
+	}
+	return w
+}
@@ -0,0 +1,133 @@
+package echoprometheus
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestTTFBWithLateHeader(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config, registry := newTestConfig()
+	config.EnableTTFB = true
+	config.NowFunc = clock.Now
+
+	e := echo.New()
+	e.Use(MetricsMiddlewareWithConfig(config))
+	e.GET("/late", func(c echo.Context) error {
+		clock.Advance(2 * time.Second)
+		c.Response().WriteHeader(http.StatusOK)
+		clock.Advance(3 * time.Second)
+		_, err := c.Response().Write([]byte("done"))
+		return err
+	})
+	serve(e, http.MethodGet, "/late")
+
+	if ttfb := sampleSum(t, registry, "echo_http_time_to_first_byte_seconds"); ttfb != 2 {
+		t.Errorf("expected a time to first byte of 2s, got %v", ttfb)
+	}
+	if duration := sampleSum(t, registry, "echo_http_request_duration_seconds"); duration != 5 {
+		t.Errorf("expected a duration of 5s, got %v", duration)
+	}
+}
+
+func TestTTFBNotObservedWithoutWrite(t *testing.T) {
+	config, registry := newTestConfig()
+	config.EnableTTFB = true
+
+	e := echo.New()
+	e.Use(MetricsMiddlewareWithConfig(config))
+	e.GET("/silent", func(c echo.Context) error {
+		return nil
+	})
+	serve(e, http.MethodGet, "/silent")
+
+	if count := sampleCount(t, registry, "echo_http_time_to_first_byte_seconds"); count != 0 {
+		t.Errorf("expected no time to first byte without write, got %d observations", count)
+	}
+}
+
+// fullWriter implements every optional interface the ttfb writer preserves
+type fullWriter struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func (w *fullWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.ResponseRecorder, r)
+}
+
+// plainWriter implements no optional interface
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestTTFBWriterKeepsInterfaces(t *testing.T) {
+	writers := map[string]struct {
+		writer                        http.ResponseWriter
+		flusher, hijacker, readerFrom bool
+	}{
+		"plain":    {plainWriter{httptest.NewRecorder()}, false, false, false},
+		"recorder": {httptest.NewRecorder(), true, false, false},
+		"full":     {&fullWriter{ResponseRecorder: httptest.NewRecorder()}, true, true, true},
+		"hijacker": {struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{httptest.NewRecorder(), &fullWriter{}}, false, true, false},
+	}
+	for name, tc := range writers {
+		t.Run(name, func(t *testing.T) {
+			w := (&ttfbWriter{ResponseWriter: tc.writer, now: time.Now}).wrap()
+			if _, ok := w.(http.Flusher); ok != tc.flusher {
+				t.Errorf("expected http.Flusher to be %v", tc.flusher)
+			}
+			if _, ok := w.(http.Hijacker); ok != tc.hijacker {
+				t.Errorf("expected http.Hijacker to be %v", tc.hijacker)
+			}
+			if _, ok := w.(io.ReaderFrom); ok != tc.readerFrom {
+				t.Errorf("expected io.ReaderFrom to be %v", tc.readerFrom)
+			}
+			if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok || u.Unwrap() != tc.writer {
+				t.Error("expected Unwrap to return the wrapped writer")
+			}
+		})
+	}
+}
+
+func TestTTFBWriterMarksFirstByte(t *testing.T) {
+	writes := map[string]func(w http.ResponseWriter){
+		"flush": func(w http.ResponseWriter) { w.(http.Flusher).Flush() },
+		"read from": func(w http.ResponseWriter) {
+			w.(io.ReaderFrom).ReadFrom(strings.NewReader("body"))
+		},
+	}
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			rw := &fullWriter{ResponseRecorder: httptest.NewRecorder()}
+			ttfb := &ttfbWriter{ResponseWriter: rw, now: time.Now}
+			write(ttfb.wrap())
+			if ttfb.firstByte.IsZero() {
+				t.Error("expected the first byte to be marked")
+			}
+		})
+	}
+
+	rw := &fullWriter{ResponseRecorder: httptest.NewRecorder()}
+	ttfb := &ttfbWriter{ResponseWriter: rw, now: time.Now}
+	ttfb.wrap().(http.Hijacker).Hijack()
+	if !rw.hijacked {
+		t.Error("expected Hijack to reach the wrapped writer")
+	}
+}